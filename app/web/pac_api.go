@@ -0,0 +1,68 @@
+package web
+
+import (
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/manager"
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/gin-gonic/gin"
+)
+
+// 根据入站代理的链接配置得到PAC中的代理指令，仅支持http入站代理及tls之上的http入站代理
+func pacProxyDirective(linkConfig map[string]interface{}) string {
+	address, _ := linkConfig["address"].(string)
+	switch linkConfig["scheme"] {
+	case "http":
+		return "PROXY " + address
+	case "tls":
+		if upper, ok := linkConfig["upper"].(map[string]interface{}); ok && upper["scheme"] == "http" {
+			return "HTTPS " + address
+		}
+	}
+	return ""
+}
+
+// 代理自动配置脚本，用户以token参数中的链接令牌认证。
+// WPAD自动发现时浏览器无法携带令牌，配置开启pac_guest时未提供令牌的请求按guest用户的路由方案生成
+func getPAC(c *gin.Context) {
+	var user *db.User
+	if token := c.Query("token"); token != "" {
+		if val, ok := manager.UserTokenMap.Load(token); ok {
+			user = val.(*db.User)
+		}
+	} else if manager.PACGuest {
+		if val, ok := manager.UserMap.Load("guest"); ok {
+			user = val.(*db.User)
+		}
+	}
+	if user == nil || !user.Enabled {
+		c.JSON(403, errorR(403, "无效的链接令牌"))
+		return
+	}
+	userGroup, err := manager.DBM.UserGroup.GetByID(user.UserGroupID)
+	if err != nil {
+		c.JSON(500, errorR(500, "Failed to fetch user group"))
+		return
+	}
+	directive := ""
+	for _, inbound := range userGroup.AvailInbounds {
+		if !inbound.Enabled {
+			continue
+		}
+		if inboundInstance, ok := manager.InboundMap.Load(inbound.ID); ok {
+			directive = pacProxyDirective(inboundInstance.(proxy.Inbound).GetLinkConfig(c.Request.Host, user.LinkToken))
+			if directive != "" {
+				break
+			}
+		}
+	}
+	if directive == "" {
+		c.JSON(404, errorR(404, "没有可用的http入站代理"))
+		return
+	}
+	script, err := manager.GeneratePAC(user.UserGroupID, directive)
+	if err != nil {
+		c.JSON(500, errorR(500, "生成PAC文件失败"))
+		return
+	}
+	c.Data(200, "application/x-ns-proxy-autoconfig", []byte(script))
+}
@@ -1,8 +1,9 @@
 package web
 
 import (
-	"strconv"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/ZIXT233/ziproxy/db"
 	"github.com/ZIXT233/ziproxy/manager"
@@ -175,19 +176,35 @@ func deleteProxyData(c *gin.Context) {
 	}))
 }
 
+// 出站代理测速，请求体可选，未提供的参数使用默认值
 func testOutboundSpeed(c *gin.Context) {
 	id := c.Param("id")
-	latency, _ := manager.MeasureLatency(id)
-	latencyStr := strconv.FormatInt(latency, 10) + "ms"
-	if latency == -1 {
-		latencyStr = "无法到达代理"
-	} else if latency == -2 {
-		latencyStr = "代理协议握手失败"
+	var req struct {
+		URL              string `json:"url"`
+		DownloadURL      string `json:"downloadUrl"`
+		Timeout          int    `json:"timeout"`          //秒
+		DownloadDuration int    `json:"downloadDuration"` //秒
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, errorR(400, "Invalid request data"))
+			return
+		}
 	}
-	c.JSON(200, successR(gin.H{
-		"proxyId": id,
-		"latency": latencyStr,
-	}))
+	result, err := manager.ProbeOutbound(id, manager.ProbeOptions{
+		URL:              req.URL,
+		DownloadURL:      req.DownloadURL,
+		Timeout:          time.Duration(req.Timeout) * time.Second,
+		DownloadDuration: time.Duration(req.DownloadDuration) * time.Second,
+	})
+	if errors.Is(err, manager.ErrOutboundNotFound) {
+		c.JSON(404, errorR(404, "Proxy not found"))
+		return
+	} else if err != nil {
+		c.JSON(400, errorR(400, err.Error()))
+		return
+	}
+	c.JSON(200, successR(result))
 }
 
 func getUsableInbounds(c *gin.Context) {
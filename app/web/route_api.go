@@ -34,6 +34,7 @@ func getAllRouteScheme(c *gin.Context) {
 				"pattern":   rule.Pattern,
 				"outbounds": outboundIds,
 				"priority":  rule.Priority,
+				"noResolve": rule.NoResolve,
 			})
 		}
 
@@ -82,6 +83,7 @@ func getRouteScheme(c *gin.Context) {
 			"pattern":   rule.Pattern,
 			"outbounds": outboundIds,
 			"priority":  rule.Priority,
+			"noResolve": rule.NoResolve,
 		})
 	}
 
@@ -224,6 +226,7 @@ func getRules(c *gin.Context) {
 			"pattern":   rule.Pattern,
 			"outbounds": outboundIds,
 			"priority":  rule.Priority,
+			"noResolve": rule.NoResolve,
 		})
 	}
 
@@ -239,6 +242,7 @@ func addRule(c *gin.Context) {
 		Pattern   string   `json:"pattern"`
 		Outbounds []string `json:"outbounds"`
 		Priority  uint     `json:"priority"`
+		NoResolve bool     `json:"noResolve"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -259,6 +263,11 @@ func addRule(c *gin.Context) {
 		Pattern:       req.Pattern,
 		RouteSchemeID: schemeId,
 		Priority:      req.Priority,
+		NoResolve:     req.NoResolve,
+	}
+	if err := manager.ValidateRule(rule); err != nil {
+		c.JSON(400, errorR(400, "无效的规则: "+err.Error()))
+		return
 	}
 
 	// 保存规则
@@ -307,6 +316,7 @@ func updateRule(c *gin.Context) {
 		Pattern   *string   `json:"pattern"`
 		Outbounds *[]string `json:"outbounds"`
 		Priority  *uint     `json:"priority"`
+		NoResolve *bool     `json:"noResolve"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -341,6 +351,15 @@ func updateRule(c *gin.Context) {
 		rule.Priority = *req.Priority
 	}
 
+	if req.NoResolve != nil {
+		rule.NoResolve = *req.NoResolve
+	}
+
+	if err := manager.ValidateRule(rule); err != nil {
+		c.JSON(400, errorR(400, "无效的规则: "+err.Error()))
+		return
+	}
+
 	if req.Outbounds != nil {
 		// 清除现有关联
 		manager.DBM.Rule.ClearOutbounds(rule.ID)
@@ -449,3 +468,26 @@ func updateRuleOrder(c *gin.Context) {
 		"message": "规则顺序更新成功",
 	}))
 }
+
+// 模拟路由，返回指定用户经指定入站代理访问目标时匹配的规则与出站代理
+func traceRoute(c *gin.Context) {
+	var req struct {
+		User        string `json:"user"`
+		Inbound     string `json:"inbound"`
+		Destination string `json:"destination"`
+		Source      string `json:"source"`
+		Resolve     bool   `json:"resolve"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, errorR(400, "无效的请求数据"))
+		return
+	}
+
+	trace, err := manager.TraceRoute(req.User, req.Inbound, req.Destination, req.Source, req.Resolve)
+	if err != nil {
+		c.JSON(400, errorR(400, "模拟路由失败: "+err.Error()))
+		return
+	}
+	c.JSON(200, successR(trace))
+}
@@ -0,0 +1,155 @@
+package web
+
+import (
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/manager"
+	"github.com/gin-gonic/gin"
+)
+
+func viewRuleSet(ruleSet *db.RuleSet) gin.H {
+	status, _ := manager.GetRuleSetStatus(ruleSet.ID)
+	return gin.H{
+		"id":       ruleSet.ID,
+		"format":   ruleSet.Format,
+		"source":   ruleSet.Source,
+		"outbound": ruleSet.OutboundID,
+		"interval": ruleSet.Interval,
+		"status":   status,
+	}
+}
+
+func getAllRuleSet(c *gin.Context) {
+	ruleSets, _, err := manager.DBM.RuleSet.List(0, db.MAX)
+	if err != nil {
+		c.JSON(500, errorR(500, "获取规则集失败"))
+		return
+	}
+	viewRuleSets := make([]gin.H, 0, len(ruleSets))
+	for _, ruleSet := range ruleSets {
+		viewRuleSets = append(viewRuleSets, viewRuleSet(&ruleSet))
+	}
+	c.JSON(200, successR(viewRuleSets))
+}
+
+func getRuleSet(c *gin.Context) {
+	ruleSet, err := manager.DBM.RuleSet.GetByID(c.Param("id"))
+	if err != nil {
+		c.JSON(404, errorR(404, "规则集不存在"))
+		return
+	}
+	c.JSON(200, successR(viewRuleSet(ruleSet)))
+}
+
+func createRuleSet(c *gin.Context) {
+	var req struct {
+		Id       string `json:"id"`
+		Format   string `json:"format"`
+		Source   string `json:"source"`
+		Outbound string `json:"outbound"`
+		Interval uint   `json:"interval"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil || req.Id == "" {
+		c.JSON(400, errorR(400, "无效的请求数据"))
+		return
+	}
+
+	ruleSet := &db.RuleSet{
+		ID:         req.Id,
+		Format:     req.Format,
+		Source:     req.Source,
+		OutboundID: req.Outbound,
+		Interval:   req.Interval,
+	}
+	if err := manager.ValidateRuleSet(ruleSet); err != nil {
+		c.JSON(400, errorR(400, "无效的规则集: "+err.Error()))
+		return
+	}
+
+	if err := manager.DBM.RuleSet.Create(ruleSet); err != nil {
+		c.JSON(500, errorR(500, "创建规则集失败"))
+		return
+	}
+	manager.SyncRuleSet(ruleSet)
+	c.JSON(200, successR(gin.H{
+		"id": ruleSet.ID,
+	}))
+}
+
+func updateRuleSet(c *gin.Context) {
+	var req struct {
+		Format   *string `json:"format"`
+		Source   *string `json:"source"`
+		Outbound *string `json:"outbound"`
+		Interval *uint   `json:"interval"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, errorR(400, "无效的请求数据"))
+		return
+	}
+
+	ruleSet, err := manager.DBM.RuleSet.GetByID(c.Param("id"))
+	if err != nil {
+		c.JSON(404, errorR(404, "规则集不存在"))
+		return
+	}
+
+	if req.Format != nil {
+		ruleSet.Format = *req.Format
+	}
+
+	if req.Source != nil {
+		ruleSet.Source = *req.Source
+	}
+
+	if req.Outbound != nil {
+		ruleSet.OutboundID = *req.Outbound
+	}
+
+	if req.Interval != nil {
+		ruleSet.Interval = *req.Interval
+	}
+
+	if err := manager.ValidateRuleSet(ruleSet); err != nil {
+		c.JSON(400, errorR(400, "无效的规则集: "+err.Error()))
+		return
+	}
+
+	if err := manager.DBM.RuleSet.Update(ruleSet); err != nil {
+		c.JSON(500, errorR(500, "更新规则集失败"))
+		return
+	}
+	manager.SyncRuleSet(ruleSet)
+	c.JSON(200, successR(gin.H{
+		"id": ruleSet.ID,
+	}))
+}
+
+func deleteRuleSet(c *gin.Context) {
+	id := c.Param("id")
+
+	if manager.RuleSetInUse(id) {
+		c.JSON(400, errorR(400, "规则集正在被路由规则使用"))
+		return
+	}
+	if err := manager.DBM.RuleSet.Delete(id); err != nil {
+		c.JSON(500, errorR(500, "删除规则集失败"))
+		return
+	}
+	manager.RemoveRuleSet(id)
+	c.JSON(200, successR(gin.H{
+		"message": "规则集删除成功",
+	}))
+}
+
+// 立即更新规则集，返回更新后的状态
+func refreshRuleSet(c *gin.Context) {
+	id := c.Param("id")
+	if err := manager.RefreshRuleSet(id); err != nil {
+		c.JSON(500, errorR(500, "更新规则集失败: "+err.Error()))
+		return
+	}
+	status, _ := manager.GetRuleSetStatus(id)
+	c.JSON(200, successR(status))
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"fmt"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/ZIXT233/ziproxy/manager"
@@ -136,3 +137,37 @@ func getMyTraffic(c *gin.Context) {
 		"links":    links,
 	}))
 }
+
+func getOutboundHealth(c *gin.Context) {
+	c.JSON(200, successR(manager.GetOutboundStatus()))
+}
+
+// 出站代理健康检查历史，hours参数指定最近多少小时，默认24
+func getOutboundHealthHistory(c *gin.Context) {
+	id := c.Param("id")
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if err != nil || hours <= 0 {
+		c.JSON(400, errorR(400, "无效的时间范围"))
+		return
+	}
+	endTime := time.Now()
+	startTime := endTime.Add(-time.Duration(hours) * time.Hour)
+	samples, err := manager.StatisticDBM.HealthSample.GetByOutboundID(id, startTime, endTime)
+	if err != nil {
+		c.JSON(500, errorR(500, "获取健康检查记录失败"))
+		return
+	}
+	history := make([]gin.H, 0, len(samples))
+	for _, s := range samples {
+		history = append(history, gin.H{
+			"time":    s.Time,
+			"success": s.Success,
+			"latency": s.Latency,
+			"error":   s.Error,
+		})
+	}
+	c.JSON(200, successR(gin.H{
+		"status":  manager.GetOutboundStatusByID(id),
+		"history": history,
+	}))
+}
@@ -50,6 +50,8 @@ func StartWeb(config *utils.RootConfig) {
 			MaxAge:           12 * time.Hour,
 		}))*/
 		r.GET("/api/system/name", getSystemName)
+		r.GET("/proxy.pac", getPAC)
+		r.GET("/wpad.dat", getPAC)
 		toAuth := r.Group("/api/auth")
 		{
 			toAuth.POST("/login", login)
@@ -114,6 +116,16 @@ func StartWeb(config *utils.RootConfig) {
 					schemes.DELETE("/:id/rules/:ruleId", deleteRule)
 					schemes.POST("/:id/rules/reorder", updateRuleOrder)
 				}
+				ruleSets := routes.Group("/rule-sets")
+				{
+					ruleSets.GET("", getAllRuleSet)
+					ruleSets.GET("/:id", getRuleSet)
+					ruleSets.POST("", createRuleSet)
+					ruleSets.PUT("/:id", updateRuleSet)
+					ruleSets.DELETE("/:id", deleteRuleSet)
+					ruleSets.POST("/:id/refresh", refreshRuleSet)
+				}
+				routes.POST("/trace", traceRoute)
 			}
 			dashboard := admin.Group("/dashboard")
 			{
@@ -123,6 +135,8 @@ func StartWeb(config *utils.RootConfig) {
 				dashboard.GET("/user-traffic-rank", getUserTrafficRank)
 
 				dashboard.GET("/active-user-link", getActiveUserLink)
+				dashboard.GET("/outbound-health", getOutboundHealth)
+				dashboard.GET("/outbound-health/:id/history", getOutboundHealthHistory)
 			}
 
 			admin.PUT("/system/info", updateSystemInfo)
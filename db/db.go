@@ -20,11 +20,14 @@ type RepoManager struct {
 	ProxyData   *ProxyDataRepo
 	RouteScheme *RouteSchemeRepo
 	Rule        *RuleRepo
+	RuleSet     *RuleSetRepo
 	SystemInfo  *SystemInfoRepo
 }
 type StatisticRepoManager struct {
-	DB      *gorm.DB
-	Traffic *TrafficRepo
+	DB           *gorm.DB
+	Traffic      *TrafficRepo
+	HealthSample *HealthSampleRepo
+	FakeIP       *FakeIPRepo
 }
 
 func OpenDB(dbPath string) (*gorm.DB, bool, error) {
@@ -65,6 +68,7 @@ func InitRepo(dbPath string) (*RepoManager, bool, error) {
 		&ProxyData{},
 		&RouteScheme{},
 		&Rule{},
+		&RuleSet{},
 		&SystemInfo{},
 	)
 	if err != nil {
@@ -77,6 +81,7 @@ func InitRepo(dbPath string) (*RepoManager, bool, error) {
 		ProxyData:   NewProxyDataRepo(db),
 		RouteScheme: NewRouteSchemeRepo(db),
 		Rule:        NewRuleRepo(db),
+		RuleSet:     NewRuleSetRepo(db),
 		SystemInfo:  NewSystemInfoRepo(db),
 	}
 	return manager, isNewDB, nil
@@ -91,13 +96,17 @@ func InitStatisticRepo(dbPath string) (*StatisticRepoManager, bool, error) {
 	// 迁移数据库表结构
 	err = db.AutoMigrate(
 		&Traffic{},
+		&HealthSample{},
+		&FakeIP{},
 	)
 	if err != nil {
 		return nil, isNewDB, err
 	}
 	manager := &StatisticRepoManager{
-		DB:      db,
-		Traffic: NewTrafficRepo(db),
+		DB:           db,
+		Traffic:      NewTrafficRepo(db),
+		HealthSample: NewHealthSampleRepo(db),
+		FakeIP:       NewFakeIPRepo(db),
 	}
 	return manager, isNewDB, nil
 }
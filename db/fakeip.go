@@ -0,0 +1,36 @@
+package db
+
+import (
+	"gorm.io/gorm"
+)
+
+type FakeIPRepo struct {
+	db *gorm.DB
+}
+
+func NewFakeIPRepo(db *gorm.DB) *FakeIPRepo {
+	return &FakeIPRepo{db: db}
+}
+
+// 保存映射，地址已存在时覆盖原有映射
+func (r *FakeIPRepo) Save(fakeIP *FakeIP) error {
+	return r.db.Save(fakeIP).Error
+}
+
+// 批量保存映射，地址已存在时覆盖原有映射
+func (r *FakeIPRepo) SaveBatch(fakeIPs []FakeIP) error {
+	if len(fakeIPs) == 0 {
+		return nil
+	}
+	return r.db.Save(&fakeIPs).Error
+}
+
+// 获取所有映射，按分配时间升序排列
+func (r *FakeIPRepo) List() ([]FakeIP, error) {
+	var fakeIPs []FakeIP
+	result := r.db.Order("time ASC").Find(&fakeIPs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return fakeIPs, nil
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type HealthSampleRepo struct {
+	db *gorm.DB
+}
+
+func NewHealthSampleRepo(db *gorm.DB) *HealthSampleRepo {
+	return &HealthSampleRepo{db: db}
+}
+
+func (r *HealthSampleRepo) Create(sample *HealthSample) error {
+	return r.db.Create(sample).Error
+}
+
+// 获取出站代理在指定时间范围内的健康检查样本，按时间升序排列
+func (r *HealthSampleRepo) GetByOutboundID(outboundID string, startTime, endTime time.Time) ([]HealthSample, error) {
+	var samples []HealthSample
+	result := r.db.
+		Where("outbound_id = ? AND time BETWEEN ? AND ?", outboundID, startTime, endTime).
+		Order("time ASC").
+		Find(&samples)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return samples, nil
+}
+
+// 获取出站代理最近的健康检查样本，按时间升序排列
+func (r *HealthSampleRepo) GetLatest(outboundID string, limit int) ([]HealthSample, error) {
+	var samples []HealthSample
+	result := r.db.
+		Where("outbound_id = ?", outboundID).
+		Order("time DESC").
+		Limit(limit).
+		Find(&samples)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+	return samples, nil
+}
+
+func (r *HealthSampleRepo) Clean(beforeTime time.Time) error {
+	return r.db.Where("time < ?", beforeTime).Delete(&HealthSample{}).Error
+}
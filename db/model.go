@@ -58,6 +58,16 @@ type Rule struct {
 	RouteScheme   RouteScheme `gorm:"foreignKey:RouteSchemeID"`  // 所属的 RouteScheme
 	Outbounds     []ProxyData `gorm:"many2many:rule_outbounds;"` // 关联的 ProxyData
 	Priority      uint        `gorm:"default:0"`                 // 优先级，值越小优先级越高
+	NoResolve     bool        `gorm:"default:false"`             // ip规则不在本地解析域名目标，域名目标直接视为不匹配
+}
+
+// 规则集，由rule-set类型的路由规则引用，内容来自本地文件或HTTP地址，定期更新
+type RuleSet struct {
+	ID         string `gorm:"primaryKey"`
+	Format     string `gorm:"not null"` // list、clash或sing-box
+	Source     string `gorm:"not null"` // 本地文件路径或http(s)地址
+	OutboundID string // 下载远程规则集使用的出站代理，为空时直接连接
+	Interval   uint   `gorm:"default:86400"` // 更新间隔秒数
 }
 
 type Traffic struct {
@@ -70,6 +80,24 @@ type Traffic struct {
 	User       User      `gorm:"foreignKey:UserID"` // 关联的用户
 	BytesIn    uint64    `gorm:"default:0"`         // 入站流量
 	BytesOut   uint64    `gorm:"default:0"`         // 出站流量
+	SourceAddr string    // 客户端地址，经PROXY协议传递时为真实客户端地址
 	DestAddr   string    `gorm:"not null"`
 	Time       time.Time `gorm:"default:CURRENT_TIMESTAMP"`
 }
+
+// 出站代理健康检查样本
+type HealthSample struct {
+	ID         uint   `gorm:"primaryKey"`
+	OutboundID string `gorm:"not null;index"`
+	Success    bool
+	Latency    int64     // 响应首字节时间，单位毫秒，失败时为-1
+	Error      string    // 失败原因
+	Time       time.Time `gorm:"index;default:CURRENT_TIMESTAMP"`
+}
+
+// Fake-IP地址与域名的映射，重启后恢复
+type FakeIP struct {
+	IP       string    `gorm:"primaryKey"`
+	Hostname string    `gorm:"not null;index"`
+	Time     time.Time // 分配时间，地址池用尽时最早分配的地址被重新使用
+}
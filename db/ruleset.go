@@ -0,0 +1,47 @@
+package db
+
+import "gorm.io/gorm"
+
+type RuleSetRepo struct {
+	db *gorm.DB
+}
+
+func NewRuleSetRepo(db *gorm.DB) *RuleSetRepo {
+	return &RuleSetRepo{db: db}
+}
+
+func (r *RuleSetRepo) Create(ruleSet *RuleSet) error {
+	return r.db.Create(ruleSet).Error
+}
+
+func (r *RuleSetRepo) GetByID(id string) (*RuleSet, error) {
+	var ruleSet RuleSet
+	result := r.db.First(&ruleSet, &RuleSet{ID: id})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &ruleSet, nil
+}
+
+func (r *RuleSetRepo) Update(ruleSet *RuleSet) error {
+	return r.db.Save(ruleSet).Error
+}
+
+func (r *RuleSetRepo) Delete(id string) error {
+	return r.db.Delete(&RuleSet{ID: id}).Error
+}
+
+func (r *RuleSetRepo) List(page, pageSize int) ([]RuleSet, int64, error) {
+	var ruleSets []RuleSet
+	var total int64
+
+	r.db.Model(&RuleSet{}).Count(&total)
+
+	offset := (page - 1) * pageSize
+	result := r.db.Offset(offset).Limit(pageSize).Find(&ruleSets)
+	if result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	return ruleSets, total, nil
+}
@@ -0,0 +1,277 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	minTTL          = 10 * time.Second
+	maxTTL          = time.Hour
+	negativeTTL     = 10 * time.Second //查询无结果时的缓存时间
+	maxCacheEntries = 4096
+)
+
+var (
+	ErrNotFound   = errors.New("no such host")
+	ErrNoUpstream = errors.New("no upstream dns server")
+)
+
+type cacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// 域名解析器，依次查询hosts静态记录、缓存和上游DNS服务器，未配置上游服务器时使用系统解析
+type Resolver struct {
+	upstreams []Upstream
+	hosts     map[string][]net.IP
+	timeout   time.Duration
+	cacheMu   sync.Mutex
+	cache     map[string]cacheEntry
+}
+
+// 创建域名解析器，hosts中的地址可以用逗号分隔多个
+func NewResolver(servers []string, hosts map[string]string, timeout time.Duration) (*Resolver, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	r := &Resolver{
+		hosts:   make(map[string][]net.IP),
+		timeout: timeout,
+		cache:   make(map[string]cacheEntry),
+	}
+	for _, server := range servers {
+		upstream, err := ParseUpstream(server)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	for host, addrs := range hosts {
+		for _, addr := range strings.Split(addrs, ",") {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid hosts address %s for %s", addr, host)
+			}
+			key := strings.ToLower(strings.TrimSuffix(host, "."))
+			r.hosts[key] = append(r.hosts[key], ip)
+		}
+	}
+	return r, nil
+}
+
+// LookupIP 解析域名，IPv4地址排在IPv6地址之前
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := r.hosts[host]; ok {
+		return ips, nil
+	}
+	if len(r.upstreams) == 0 {
+		return r.lookupSystem(host)
+	}
+	var v4, v6 []net.IP
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v4, err4 = r.lookup(host, dnsmessage.TypeA)
+	}()
+	go func() {
+		defer wg.Done()
+		v6, err6 = r.lookup(host, dnsmessage.TypeAAAA)
+	}()
+	wg.Wait()
+	ips := append(v4, v6...)
+	if len(ips) == 0 {
+		if err4 != nil {
+			return nil, err4
+		}
+		if err6 != nil {
+			return nil, err6
+		}
+		return nil, ErrNotFound
+	}
+	return ips, nil
+}
+
+// Exchange 将原始查询报文依次转发给上游服务器，返回首个成功的响应，未配置上游服务器时返回ErrNoUpstream
+func (r *Resolver) Exchange(msg []byte) ([]byte, error) {
+	return Exchange(r.upstreams, msg, r.timeout)
+}
+
+// Exchange 将原始查询报文依次转发给给定的上游服务器，返回首个成功的响应
+func Exchange(upstreams []Upstream, msg []byte, timeout time.Duration) ([]byte, error) {
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstream
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	for _, upstream := range upstreams {
+		var resp []byte
+		resp, err = upstream.Exchange(ctx, msg)
+		if err == nil {
+			return resp, nil
+		}
+		err = fmt.Errorf("%s: %v", upstream, err)
+	}
+	return nil, err
+}
+
+func (r *Resolver) lookupSystem(host string) ([]net.IP, error) {
+	key := host + "/system"
+	if ips, ok := r.loadCache(key); ok {
+		return ips, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 []net.IP
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			v4 = append(v4, addr.IP)
+		} else {
+			v6 = append(v6, addr.IP)
+		}
+	}
+	ips := append(v4, v6...)
+	//系统解析不提供TTL，按最短缓存时间处理
+	r.storeCache(key, ips, minTTL)
+	return ips, nil
+}
+
+// 查询单一类型的记录，依次尝试各上游服务器直到成功
+func (r *Resolver) lookup(host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := host + "/" + qtype.String()
+	if ips, ok := r.loadCache(key); ok {
+		return ips, nil
+	}
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	for _, upstream := range r.upstreams {
+		var resp []byte
+		resp, err = upstream.Exchange(ctx, packed)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", upstream, err)
+			continue
+		}
+		var ips []net.IP
+		var ttl time.Duration
+		ips, ttl, err = parseResponse(resp, msg.Header.ID, qtype)
+		if err != nil {
+			err = fmt.Errorf("%s: %v", upstream, err)
+			continue
+		}
+		r.storeCache(key, ips, ttl)
+		return ips, nil
+	}
+	return nil, err
+}
+
+// 解析响应报文中的地址记录，返回地址列表及其中最小的TTL。域名不存在或没有该类型记录时返回空列表
+func parseResponse(resp []byte, id uint16, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	if msg.Header.ID != id {
+		return nil, 0, errors.New("mismatched response id")
+	}
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeTTL, nil
+	default:
+		return nil, 0, fmt.Errorf("server returned %s", msg.Header.RCode)
+	}
+	var ips []net.IP
+	ttl := maxTTL
+	for _, answer := range msg.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				ip = net.IP(body.A[:])
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				ip = net.IP(body.AAAA[:])
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+		if t := time.Duration(answer.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	if len(ips) == 0 {
+		return nil, negativeTTL, nil
+	}
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	return ips, ttl, nil
+}
+
+func (r *Resolver) loadCache(key string) ([]net.IP, bool) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expire) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry.ips, true
+}
+
+// 缓存条目过多时先清理过期条目，仍然过多时清空缓存
+func (r *Resolver) storeCache(key string, ips []net.IP, ttl time.Duration) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	now := time.Now()
+	if len(r.cache) >= maxCacheEntries {
+		for k, entry := range r.cache {
+			if now.After(entry.expire) {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= maxCacheEntries {
+			r.cache = make(map[string]cacheEntry)
+		}
+	}
+	r.cache[key] = cacheEntry{ips: ips, expire: now.Add(ttl)}
+}
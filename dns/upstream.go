@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 上游DNS服务器，交换原始DNS报文
+type Upstream interface {
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+	String() string
+}
+
+// 解析上游DNS服务器地址，支持udp://、tcp://、tls://(DoT)和https://(DoH，本地测试时也可用http://)，不带协议时为UDP，端口号缺省时使用协议默认端口
+func ParseUpstream(server string) (Upstream, error) {
+	scheme, addr := "udp", server
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme, addr = server[:i], server[i+3:]
+	}
+	switch scheme {
+	case "udp":
+		return &udpUpstream{addr: withPort(addr, "53")}, nil
+	case "tcp":
+		return &tcpUpstream{addr: withPort(addr, "53")}, nil
+	case "tls":
+		addr = withPort(addr, "853")
+		host, _, _ := net.SplitHostPort(addr)
+		return &tlsUpstream{addr: addr, config: &tls.Config{ServerName: host}}, nil
+	case "https", "http":
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		return &httpsUpstream{url: u.String(), client: &http.Client{}}, nil
+	}
+	return nil, fmt.Errorf("unsupported dns server %s", server)
+}
+
+func withPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+	}
+	return addr
+}
+
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) String() string { return "udp://" + u.addr }
+
+// 响应被截断时改用TCP重新查询
+func (u *udpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n > 2 && buf[2]&0x02 != 0 {
+		return (&tcpUpstream{addr: u.addr}).Exchange(ctx, msg)
+	}
+	return buf[:n], nil
+}
+
+type tcpUpstream struct {
+	addr string
+}
+
+func (u *tcpUpstream) String() string { return "tcp://" + u.addr }
+
+func (u *tcpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ExchangeStream(ctx, conn, msg)
+}
+
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+func (u *tlsUpstream) String() string { return "tls://" + u.addr }
+
+func (u *tlsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	d := tls.Dialer{Config: u.config}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ExchangeStream(ctx, conn, msg)
+}
+
+// ExchangeStream 在流式连接上交换一次DNS报文，TCP和DoT的报文带两字节长度前缀
+func ExchangeStream(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	req := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(req, uint16(len(msg)))
+	copy(req[2:], msg)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+// RFC 8484，以POST方式发送application/dns-message报文
+func (u *httpsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh server returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
@@ -13,10 +13,19 @@ import (
 	"github.com/ZIXT233/ziproxy/app/web"
 	"github.com/ZIXT233/ziproxy/manager"
 	_ "github.com/ZIXT233/ziproxy/proxy/direct"
+	_ "github.com/ZIXT233/ziproxy/proxy/dns"
+	_ "github.com/ZIXT233/ziproxy/proxy/group"
+	_ "github.com/ZIXT233/ziproxy/proxy/h2"
 	_ "github.com/ZIXT233/ziproxy/proxy/http"
+	_ "github.com/ZIXT233/ziproxy/proxy/mux"
 	_ "github.com/ZIXT233/ziproxy/proxy/raw"
+	_ "github.com/ZIXT233/ziproxy/proxy/redirect"
 	_ "github.com/ZIXT233/ziproxy/proxy/rev_http"
+	_ "github.com/ZIXT233/ziproxy/proxy/shadowsocks"
+	_ "github.com/ZIXT233/ziproxy/proxy/socks5"
 	_ "github.com/ZIXT233/ziproxy/proxy/tls"
+	_ "github.com/ZIXT233/ziproxy/proxy/trojan"
+	_ "github.com/ZIXT233/ziproxy/proxy/ws"
 	"github.com/ZIXT233/ziproxy/utils"
 )
 
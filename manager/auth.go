@@ -2,26 +2,53 @@ package manager
 
 import (
 	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/utils"
 )
 
+func init() {
+	proxy.LinkTokens = linkTokens
+	proxy.UserEnabled = userEnabled
+}
+
+func userEnabled(userId string) bool {
+	if val, ok := UserMap.Load(userId); ok {
+		return val.(*db.User).Enabled
+	}
+	return false
+}
+
+// 只返回已启用用户的linkToken，被禁用用户的凭据在查找表中与错误密码一样无法匹配，连接转发到fallback或被拒绝
+func linkTokens() []string {
+	var tokens []string
+	UserTokenMap.Range(func(key, value interface{}) bool {
+		if user, ok := value.(*db.User); ok && user.Enabled {
+			tokens = append(tokens, key.(string))
+		}
+		return true
+	})
+	return tokens
+}
+
 func proxyAuth(info map[string]string) string {
 	if token, ok := info["linkToken"]; ok {
 		if val, ok := UserTokenMap.Load(token); ok {
-			if user, ok := val.(*db.User); ok {
+			if user, ok := val.(*db.User); ok && user.Enabled {
 				return user.ID
 			}
 		}
-	} /*
-		if userId, ok := info["username"]; ok {
-			if password, ok := info["password"]; ok {
-				if val, ok := UserMap.Load(userId); ok {
-					if user, ok := val.(*db.User); ok {
-						if user.Password == password {
-							return userId
-						}
+	}
+	//用户名密码认证，数据库中保存的是密码的SHA256摘要
+	if userId, ok := info["username"]; ok {
+		if password, ok := info["password"]; ok {
+			if val, ok := UserMap.Load(userId); ok {
+				if user, ok := val.(*db.User); ok {
+					if user.Enabled && user.Password == utils.SHA256([]byte(password)) {
+						return userId
 					}
 				}
 			}
-		}*/
+		}
+	}
 	return "guest"
 }
@@ -0,0 +1,26 @@
+package manager
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ZIXT233/ziproxy/db"
+)
+
+// 被禁用用户的linkToken不进入trojan、shadowsocks等入站代理的查找表
+func TestLinkTokensSkipDisabled(t *testing.T) {
+	SyncUser(&db.User{ID: "auth-enabled", LinkToken: "token-enabled", Enabled: true})
+	SyncUser(&db.User{ID: "auth-disabled", LinkToken: "token-disabled", Enabled: false})
+	defer RemoveUser("auth-enabled")
+	defer RemoveUser("auth-disabled")
+
+	tokens := linkTokens()
+	if !slices.Contains(tokens, "token-enabled") || slices.Contains(tokens, "token-disabled") {
+		t.Errorf("linkTokens = %v", tokens)
+	}
+
+	SyncUser(&db.User{ID: "auth-disabled", LinkToken: "token-disabled", Enabled: true})
+	if !slices.Contains(linkTokens(), "token-disabled") {
+		t.Error("re-enabled user's token missing")
+	}
+}
@@ -28,7 +28,8 @@ func loadDefaultData(dbm *db.RepoManager) {
 		Enabled:   true,
 		Config: `{ 
       "scheme": "http",
-      "address": "localhost:8080"
+      "address": "localhost:8080",
+      "allowGuest": true
     }`,
 	}
 	inboundProxy2 := &db.ProxyData{
@@ -0,0 +1,294 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/dns"
+	"github.com/ZIXT233/ziproxy/proxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultRemoteDNS = "8.8.8.8:53"
+	blockAnswerTTL   = 60
+	fakeIPAnswerTTL  = 1  //Fake-IP应答使用极短的TTL，避免客户端长期缓存已被重新分配的地址
+	systemAnswerTTL  = 10 //系统解析没有TTL信息，构造响应时使用的TTL
+
+	remoteDNSIdleTimeout = 8 * time.Second //远程DNS服务器连接的最长空闲时间，需短于出站连接的超时时间
+	remoteDNSMaxIdle     = 4               //每个出站代理保留的空闲连接数量
+)
+
+// DNS服务器入站代理的查询处理。查询域名作为代理目标交由路由方案匹配：
+// 匹配到直连出站代理时查询本地上游服务器，匹配到block时按配置应答NXDOMAIN或0.0.0.0，
+// 其余情况通过匹配到的出站代理以TCP方式转发给远程DNS服务器，开启fakeIp时A查询直接应答Fake-IP地址。
+// 查询域名路由时不在本地解析，ip、geoip规则视为不匹配
+type dnsServer struct {
+	inbound    proxy.Inbound
+	user       string //路由时使用的用户，默认为guest
+	remote     string
+	local      []dns.Upstream
+	blockZero  bool
+	fakeIP     bool
+	remoteMu   sync.Mutex
+	remoteIdle map[string][]*remoteDNSConn //出站代理ID -> 远程DNS服务器的空闲连接
+}
+
+// 经由出站代理连接远程DNS服务器的TCP连接，查询完成后放回空闲连接中复用
+type remoteDNSConn struct {
+	outbound  proxy.Outbound
+	outConn   *ConnWithTimeout
+	conn      net.Conn
+	closeChan chan struct{}
+	idleSince time.Time
+}
+
+func (c *remoteDNSConn) close() {
+	c.outConn.Close()
+	c.outbound.UnregCloseChan(c.closeChan)
+}
+
+func newDNSServer(inbound proxy.Inbound) (*dnsServer, error) {
+	config := inbound.Config()
+	s := &dnsServer{inbound: inbound, user: "guest", remote: defaultRemoteDNS, remoteIdle: make(map[string][]*remoteDNSConn)}
+	if user, ok := config["user"].(string); ok && user != "" {
+		s.user = user
+	}
+	if remote, ok := config["remote"].(string); ok && remote != "" {
+		s.remote = remote
+	}
+	if _, err := proxy.NewTargetAddr(s.remote); err != nil {
+		return nil, fmt.Errorf("invalid remote dns server %s", s.remote)
+	}
+	list, _ := config["local"].([]interface{})
+	for _, v := range list {
+		server, ok := v.(string)
+		if !ok {
+			continue
+		}
+		upstream, err := dns.ParseUpstream(server)
+		if err != nil {
+			return nil, err
+		}
+		s.local = append(s.local, upstream)
+	}
+	switch config["block"] {
+	case nil, "nxdomain":
+	case "zero":
+		s.blockZero = true
+	default:
+		return nil, fmt.Errorf("block must be nxdomain or zero")
+	}
+	s.fakeIP, _ = config["fakeIp"].(bool)
+	if s.fakeIP && FakeIPPool == nil {
+		return nil, fmt.Errorf("fakeIp requires dns.fake_ip_range to be configured")
+	}
+	return s, nil
+}
+
+// 解析失败的报文不做响应
+func (s *dnsServer) handle(msg []byte, src net.Addr) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(msg); err != nil || len(req.Questions) == 0 {
+		return nil
+	}
+	q := req.Questions[0]
+	target := &proxy.TargetAddr{Hostname: strings.TrimSuffix(q.Name.String(), "."), Port: 53, UserId: s.user}
+	candidates := routeOutbounds(target, s.inbound.Name(), addrIP(src.String()), nil)
+	if candidates[0] == "block" {
+		log.Printf("Block %s@%s ---> dns:%s %s\t\tfrom %s", s.user, s.inbound.Name(), target.Hostname, q.Type, src)
+		return s.blockResponse(&req)
+	}
+
+	var resp []byte
+	var err error
+	if outbound, ok := resolveOutbound(candidates[0], target); ok && isDirectOutbound(outbound) {
+		resp, err = s.exchangeLocal(msg, &req)
+	} else if s.fakeIP && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		return s.fakeIPResponse(&req, target.Hostname)
+	} else {
+		resp, err = s.exchangeRemote(msg, candidates)
+	}
+	if err != nil {
+		log.Printf("DNS %s@%s ---> dns:%s %s failed: %v", s.user, s.inbound.Name(), target.Hostname, q.Type, err)
+		return errorResponse(&req, dnsmessage.RCodeServerFailure)
+	}
+	return resp
+}
+
+// 查询本地上游服务器，入站代理未配置local时使用全局DNS配置，均未配置时只支持A和AAAA查询，由系统解析后构造响应
+func (s *dnsServer) exchangeLocal(msg []byte, req *dnsmessage.Message) ([]byte, error) {
+	if len(s.local) > 0 {
+		return dns.Exchange(s.local, msg, DialTimeout)
+	}
+	resp, err := Resolver.Exchange(msg)
+	if !errors.Is(err, dns.ErrNoUpstream) {
+		return resp, err
+	}
+	q := req.Questions[0]
+	if q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return errorResponse(req, dnsmessage.RCodeNotImplemented), nil
+	}
+	ips, err := Resolver.LookupIP(strings.TrimSuffix(q.Name.String(), "."))
+	if err != nil {
+		return errorResponse(req, dnsmessage.RCodeNameError), nil
+	}
+	reply := replyTo(req)
+	for _, ip := range ips {
+		reply.Answers = appendAddrAnswer(reply.Answers, q, ip, systemAnswerTTL)
+	}
+	return reply.Pack()
+}
+
+// 通过路由匹配的出站代理依次尝试连接远程DNS服务器，以TCP方式交换报文
+func (s *dnsServer) exchangeRemote(msg []byte, candidates []string) ([]byte, error) {
+	var attempted []string
+	for _, outboundName := range candidates {
+		if outboundName == "block" || len(attempted) >= DialAttempts {
+			break
+		}
+		target, _ := proxy.NewTargetAddr(s.remote)
+		target.UserId = s.user
+		outbound, ok := resolveOutbound(outboundName, target)
+		if !ok {
+			attempted = append(attempted, outboundName+"(not found)")
+			continue
+		}
+		resp, err := s.exchangeVia(outbound, target, msg)
+		if err != nil {
+			attempted = append(attempted, fmt.Sprintf("%s(%v)", outbound.Name(), err))
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("tried %s", strings.Join(attempted, ", "))
+}
+
+// 经由出站代理交换报文，优先使用空闲连接，空闲连接可能已被远程服务器关闭，失败时新建连接重试一次
+func (s *dnsServer) exchangeVia(outbound proxy.Outbound, target *proxy.TargetAddr, msg []byte) ([]byte, error) {
+	conn, pooled := s.idleRemoteConn(outbound)
+	for {
+		if conn == nil {
+			outConn, wrappedOutConn, outCloseChan, err := dialOutbound(outbound, target, nil, nil)
+			if err != nil {
+				outbound.UnregCloseChan(outCloseChan)
+				return nil, err
+			}
+			conn = &remoteDNSConn{outbound: outbound, outConn: outConn, conn: wrappedOutConn, closeChan: outCloseChan}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+		resp, err := dns.ExchangeStream(ctx, conn.conn, msg)
+		cancel()
+		if err == nil {
+			conn.conn.SetDeadline(time.Time{})
+			s.releaseRemoteConn(conn)
+			return resp, nil
+		}
+		conn.close()
+		if !pooled {
+			return nil, err
+		}
+		conn, pooled = nil, false
+	}
+}
+
+// 取出出站代理的空闲连接，出站代理已重新加载或连接空闲过久时关闭
+func (s *dnsServer) idleRemoteConn(outbound proxy.Outbound) (*remoteDNSConn, bool) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+	idle := s.remoteIdle[outbound.Name()]
+	for len(idle) > 0 {
+		conn := idle[len(idle)-1]
+		idle = idle[:len(idle)-1]
+		if conn.outbound == outbound && !conn.outConn.IsTimeout() && time.Since(conn.idleSince) < remoteDNSIdleTimeout {
+			s.remoteIdle[outbound.Name()] = idle
+			return conn, true
+		}
+		conn.close()
+	}
+	delete(s.remoteIdle, outbound.Name())
+	return nil, false
+}
+
+// 查询完成后放回空闲连接，已超时关闭或超过数量上限时关闭
+func (s *dnsServer) releaseRemoteConn(conn *remoteDNSConn) {
+	s.remoteMu.Lock()
+	defer s.remoteMu.Unlock()
+	idle := s.remoteIdle[conn.outbound.Name()]
+	if conn.outConn.IsTimeout() || len(idle) >= remoteDNSMaxIdle {
+		conn.close()
+		return
+	}
+	conn.idleSince = time.Now()
+	s.remoteIdle[conn.outbound.Name()] = append(idle, conn)
+}
+
+func (s *dnsServer) blockResponse(req *dnsmessage.Message) []byte {
+	q := req.Questions[0]
+	if !s.blockZero {
+		return errorResponse(req, dnsmessage.RCodeNameError)
+	}
+	reply := replyTo(req)
+	switch q.Type {
+	case dnsmessage.TypeA:
+		reply.Answers = appendAddrAnswer(reply.Answers, q, net.IPv4zero, blockAnswerTTL)
+	case dnsmessage.TypeAAAA:
+		reply.Answers = appendAddrAnswer(reply.Answers, q, net.IPv6zero, blockAnswerTTL)
+	}
+	resp, _ := reply.Pack()
+	return resp
+}
+
+// 经由代理的域名应答Fake-IP地址，连接到达时再还原为域名，由远程代理解析。地址池只有IPv4，AAAA查询应答空记录
+func (s *dnsServer) fakeIPResponse(req *dnsmessage.Message, hostname string) []byte {
+	q := req.Questions[0]
+	reply := replyTo(req)
+	if q.Type == dnsmessage.TypeA {
+		reply.Answers = appendAddrAnswer(reply.Answers, q, FakeIPPool.Lookup(hostname), fakeIPAnswerTTL)
+	}
+	resp, _ := reply.Pack()
+	return resp
+}
+
+// 构造与查询对应的空响应
+func replyTo(req *dnsmessage.Message) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.Header.ID,
+			Response:           true,
+			OpCode:             req.Header.OpCode,
+			RecursionDesired:   req.Header.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: req.Questions,
+	}
+}
+
+func errorResponse(req *dnsmessage.Message, rcode dnsmessage.RCode) []byte {
+	reply := replyTo(req)
+	reply.Header.RCode = rcode
+	resp, _ := reply.Pack()
+	return resp
+}
+
+// 按查询类型添加地址记录，地址族与查询类型不符时忽略
+func appendAddrAnswer(answers []dnsmessage.Resource, q dnsmessage.Question, ip net.IP, ttl uint32) []dnsmessage.Resource {
+	header := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+	if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+		var a [4]byte
+		copy(a[:], ip4)
+		return append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: a}})
+	}
+	if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+		var aaaa [16]byte
+		copy(aaaa[:], ip.To16())
+		return append(answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+	}
+	return answers
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	_ "github.com/ZIXT233/ziproxy/proxy/direct"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// 本地TCP DNS服务器，原样返回查询报文并记录建立的连接数
+func startEchoDNS(t *testing.T) (string, *atomic.Int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := new(atomic.Int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, msg); err != nil {
+						return
+					}
+					conn.Write(append(length[:], msg...))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func TestExchangeRemoteReusesConn(t *testing.T) {
+	addr, accepted := startEchoDNS(t)
+	out, err := proxy.OutboundFromConfig("dns-direct", map[string]interface{}{"scheme": "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	OutboundMap.Store("dns-direct", out)
+	defer OutboundMap.Delete("dns-direct")
+
+	s := &dnsServer{user: "guest", remote: addr, remoteIdle: make(map[string][]*remoteDNSConn)}
+	for i := 0; i < 3; i++ {
+		msg, _ := (&dnsmessage.Message{Header: dnsmessage.Header{ID: uint16(i)}}).Pack()
+		resp, err := s.exchangeRemote(msg, []string{"dns-direct"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(resp) != string(msg) {
+			t.Fatalf("query %d got unexpected response", i)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("dialed %d connections for 3 queries, want 1", n)
+	}
+
+	//空闲连接失效后重新建立连接
+	for _, conn := range s.remoteIdle["dns-direct"] {
+		conn.conn.Close()
+	}
+	msg, _ := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 9}}).Pack()
+	if _, err := s.exchangeRemote(msg, []string{"dns-direct"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("dialed %d connections after idle close, want 2", n)
+	}
+}
+
+// 超时检测协程关闭的连接不再放回或取出复用
+func TestRemoteConnTimeoutNotReused(t *testing.T) {
+	addr, accepted := startEchoDNS(t)
+	out, err := proxy.OutboundFromConfig("dns-timeout", map[string]interface{}{"scheme": "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	OutboundMap.Store("dns-timeout", out)
+	defer OutboundMap.Delete("dns-timeout")
+
+	s := &dnsServer{user: "guest", remote: addr, remoteIdle: make(map[string][]*remoteDNSConn)}
+	msg, _ := (&dnsmessage.Message{Header: dnsmessage.Header{ID: 1}}).Pack()
+	if _, err := s.exchangeRemote(msg, []string{"dns-timeout"}); err != nil {
+		t.Fatal(err)
+	}
+	idle := s.remoteIdle["dns-timeout"]
+	if len(idle) != 1 {
+		t.Fatalf("idle conns = %d, want 1", len(idle))
+	}
+	idle[0].outConn.isTimeout.Store(true)
+	if _, ok := s.idleRemoteConn(out); ok {
+		t.Error("timed out conn taken from pool")
+	}
+
+	conn := idle[0]
+	s.releaseRemoteConn(conn)
+	if n := len(s.remoteIdle["dns-timeout"]); n != 0 {
+		t.Errorf("timed out conn released to pool, idle = %d", n)
+	}
+	if _, err := s.exchangeRemote(msg, []string{"dns-timeout"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("dialed %d connections, want 2", n)
+	}
+}
@@ -0,0 +1,177 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// Fake-IP地址池，DNS服务器为经由代理的域名分配地址池中的虚拟地址，
+// 透明代理等只能得到目标地址的连接到达时，据此还原目标域名后再进行路由。
+// 地址按顺序分配，用尽后重新使用最早分配的地址，映射保存在统计数据库中，重启后恢复。
+// 新分配的映射先放入待保存队列，由后台协程在锁外批量写入数据库，DNS查询不等待数据库写入
+type fakeIPPool struct {
+	mu       sync.Mutex
+	network  *net.IPNet
+	base     uint32
+	size     uint32
+	cursor   uint32            //下一个分配的地址偏移
+	ipToHost map[uint32]string //地址偏移 -> 域名
+	hostToIP map[string]uint32
+	pending  map[uint32]db.FakeIP //尚未保存的映射，同一地址只保存最新的映射
+	flush    chan struct{}
+}
+
+// 批量保存映射前等待的时间，期间分配的映射合并为一次写入
+const fakeIPFlushDelay = time.Second
+
+var FakeIPPool *fakeIPPool
+
+// 根据配置的地址范围创建地址池并恢复已保存的映射，目前只支持IPv4
+func initFakeIP(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ip4 := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip4 == nil || bits != 32 || bits-ones < 2 {
+		return errors.New("fake ip range must be an IPv4 network with at least 4 addresses")
+	}
+	pool := &fakeIPPool{
+		network:  network,
+		base:     binary.BigEndian.Uint32(ip4),
+		size:     1 << (bits - ones),
+		cursor:   1,
+		ipToHost: make(map[uint32]string),
+		hostToIP: make(map[string]uint32),
+		pending:  make(map[uint32]db.FakeIP),
+		flush:    make(chan struct{}, 1),
+	}
+	fakeIPs, err := StatisticDBM.FakeIP.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range fakeIPs {
+		offset, ok := pool.offset(net.ParseIP(f.IP))
+		if !ok {
+			continue
+		}
+		pool.bind(offset, f.Hostname)
+		pool.cursor = pool.nextOffset(offset)
+	}
+	FakeIPPool = pool
+	go pool.persist()
+	log.Printf("Fake ip pool %s restored %d mappings", cidr, len(pool.ipToHost))
+	return nil
+}
+
+// 地址在地址池中的偏移，网络地址和广播地址不使用
+func (p *fakeIPPool) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !p.network.Contains(ip4) {
+		return 0, false
+	}
+	offset := binary.BigEndian.Uint32(ip4) - p.base
+	return offset, offset > 0 && offset < p.size-1
+}
+
+func (p *fakeIPPool) nextOffset(offset uint32) uint32 {
+	if offset+1 >= p.size-1 {
+		return 1
+	}
+	return offset + 1
+}
+
+func (p *fakeIPPool) ip(offset uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.base+offset)
+	return ip
+}
+
+func (p *fakeIPPool) bind(offset uint32, host string) {
+	if old, ok := p.ipToHost[offset]; ok {
+		delete(p.hostToIP, old)
+	}
+	p.ipToHost[offset] = host
+	p.hostToIP[host] = offset
+}
+
+// Contains 判断地址是否属于地址池
+func (p *fakeIPPool) Contains(ip net.IP) bool {
+	_, ok := p.offset(ip)
+	return ok
+}
+
+// Lookup 获取域名对应的虚拟地址，没有时分配新地址并保存映射
+func (p *fakeIPPool) Lookup(host string) net.IP {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset, ok := p.hostToIP[host]; ok {
+		return p.ip(offset)
+	}
+	offset := p.cursor
+	p.cursor = p.nextOffset(offset)
+	p.bind(offset, host)
+	ip := p.ip(offset)
+	p.pending[offset] = db.FakeIP{IP: ip.String(), Hostname: host, Time: time.Now()}
+	select {
+	case p.flush <- struct{}{}:
+	default:
+	}
+	return ip
+}
+
+// 后台批量保存新分配的映射
+func (p *fakeIPPool) persist() {
+	for range p.flush {
+		time.Sleep(fakeIPFlushDelay)
+		p.mu.Lock()
+		if len(p.pending) == 0 {
+			p.mu.Unlock()
+			continue
+		}
+		batch := make([]db.FakeIP, 0, len(p.pending))
+		for _, f := range p.pending {
+			batch = append(batch, f)
+		}
+		p.pending = make(map[uint32]db.FakeIP)
+		p.mu.Unlock()
+		if err := StatisticDBM.FakeIP.SaveBatch(batch); err != nil {
+			log.Printf("Failed to save %d fake ip mappings err: %v", len(batch), err)
+		}
+	}
+}
+
+// LookupHost 获取虚拟地址对应的域名
+func (p *fakeIPPool) LookupHost(ip net.IP) (string, bool) {
+	offset, ok := p.offset(ip)
+	if !ok {
+		return "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, ok := p.ipToHost[offset]
+	return host, ok
+}
+
+// 代理目标为虚拟地址时还原为对应的域名，之后按域名路由和拨号
+func restoreFakeIP(target *proxy.TargetAddr) {
+	if FakeIPPool == nil || target.Hostname != "" || !FakeIPPool.Contains(target.IP) {
+		return
+	}
+	if host, ok := FakeIPPool.LookupHost(target.IP); ok {
+		target.Hostname = host
+		target.IP = nil
+	} else {
+		log.Printf("Fake ip %s has no mapped domain", target.IP)
+	}
+}
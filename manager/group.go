@@ -0,0 +1,31 @@
+package manager
+
+import (
+	"log"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/group"
+)
+
+// 分组嵌套的最大层数，防止分组之间互相引用导致死循环
+const maxGroupDepth = 8
+
+// 加载路由匹配到的出站代理实例，出站代理分组按策略逐层解析为实际使用的成员出站代理
+func resolveOutbound(id string, target *proxy.TargetAddr) (proxy.Outbound, bool) {
+	for depth := 0; depth < maxGroupDepth; depth++ {
+		val, ok := OutboundMap.Load(id)
+		if !ok {
+			return nil, false
+		}
+		g, isGroup := val.(*group.Outbound)
+		if !isGroup {
+			return val.(proxy.Outbound), true
+		}
+		id = g.Select(target, func(member string) bool {
+			_, ok := OutboundMap.Load(member)
+			return ok
+		})
+	}
+	log.Printf("Outbound group %s nested too deep", id)
+	return nil, false
+}
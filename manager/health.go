@@ -0,0 +1,272 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/group"
+)
+
+const (
+	healthFlapWindow    = 10 //判断状态抖动时参考的最近样本数量
+	healthFlapThreshold = 3  //最近样本中状态变化达到该次数视为抖动
+)
+
+// 出站代理健康检查间隔，可在config.json中通过health_check_interval配置
+var HealthCheckInterval = 5 * time.Minute
+
+// OutboundStatus 出站代理当前健康状态，由最近的健康检查样本得出
+type OutboundStatus struct {
+	OutboundID string    `json:"outboundId"`
+	Checked    bool      `json:"checked"` //是否已有健康检查样本
+	Up         bool      `json:"up"`
+	Latency    int64     `json:"latency"` //最近一次检查的响应首字节时间，单位毫秒，失败时为-1
+	Error      string    `json:"error,omitempty"`
+	LastCheck  time.Time `json:"lastCheck"`
+	LastChange time.Time `json:"lastChange"` //最近一次状态变化的时间，最近样本中没有变化时为最早样本时间
+	Flapping   bool      `json:"flapping"`
+	Uptime     float64   `json:"uptime"` //最近样本中检查成功的比例
+}
+
+// 出站代理最近一次健康检查的结果，用于安排下次检查时间和更新分组成员的健康状态
+type healthResult struct {
+	time    time.Time
+	latency int64
+	err     error
+}
+
+var (
+	healthMu      sync.Mutex
+	healthResults = make(map[string]healthResult) //出站代理ID -> 最近一次健康检查结果
+	healthWake    = make(chan struct{}, 1)
+)
+
+// 出站代理健康监控，按各出站代理的检查间隔并发测速并记录到统计数据库，同时更新分组成员的健康状态。
+// 出站代理分组不直接测速，由其成员体现；分组成员按health_check_interval与分组interval中较短者检查
+func HealthMonitorCron() {
+	go func() {
+		for {
+			wait := checkDueOutbounds()
+			if wait <= 0 {
+				<-healthWake
+				continue
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-healthWake:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// 出站代理配置变化后唤醒健康监控，新增的出站代理立即检查，分组立即获得成员的健康状态
+func wakeHealthMonitor() {
+	select {
+	case healthWake <- struct{}{}:
+	default:
+	}
+}
+
+// 计算各非分组出站代理的检查间隔，不需要检查的出站代理不在结果中。分组成员按其所在各分组(含嵌套)的最短间隔检查
+func healthIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration)
+	setInterval := func(id string, interval time.Duration) {
+		if cur, ok := intervals[id]; !ok || interval < cur {
+			intervals[id] = interval
+		}
+	}
+	OutboundMap.Range(func(key, value interface{}) bool {
+		g, isGroup := value.(*group.Outbound)
+		if !isGroup {
+			if HealthCheckInterval > 0 {
+				setInterval(key.(string), HealthCheckInterval)
+			}
+			return true
+		}
+		var expand func(members []string, depth int)
+		expand = func(members []string, depth int) {
+			for _, member := range members {
+				val, ok := OutboundMap.Load(member)
+				if !ok {
+					continue
+				}
+				if sub, isGroup := val.(*group.Outbound); isGroup {
+					if depth < maxGroupDepth {
+						expand(sub.Members(), depth+1)
+					}
+					continue
+				}
+				setInterval(member, g.Interval())
+			}
+		}
+		expand(g.Members(), 1)
+		return true
+	})
+	return intervals
+}
+
+// 检查所有到期的出站代理，返回距离下一次检查的时间，没有需要检查的出站代理时返回0
+func checkDueOutbounds() time.Duration {
+	intervals := healthIntervals()
+	now := time.Now()
+	var due []string
+	healthMu.Lock()
+	for id := range healthResults {
+		if _, ok := intervals[id]; !ok {
+			delete(healthResults, id)
+		}
+	}
+	for id, interval := range intervals {
+		if last, ok := healthResults[id]; !ok || now.Sub(last.time) >= interval {
+			due = append(due, id)
+		}
+	}
+	healthMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, id := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkOutbound(id)
+		}()
+	}
+	wg.Wait()
+	feedGroupHealth()
+
+	var wait time.Duration
+	now = time.Now()
+	healthMu.Lock()
+	for id, interval := range intervals {
+		next := interval
+		if last, ok := healthResults[id]; ok {
+			next = last.time.Add(interval).Sub(now)
+		}
+		if wait == 0 || next < wait {
+			wait = max(next, time.Second)
+		}
+	}
+	healthMu.Unlock()
+	return wait
+}
+
+// 测速单个出站代理，结果作为样本记录在统计数据库中，失败时延迟记为-1
+func checkOutbound(id string) {
+	sample := &db.HealthSample{OutboundID: id, Latency: -1, Time: time.Now()}
+	result, err := ProbeOutbound(id, ProbeOptions{})
+	if err != nil {
+		sample.Error = err.Error()
+	} else if !result.Success {
+		sample.Error = result.Error
+	} else {
+		sample.Success = true
+		sample.Latency = result.TTFBMs
+	}
+	if err := StatisticDBM.HealthSample.Create(sample); err != nil {
+		log.Printf("Failed to save health sample of %s err: %v", id, err)
+	}
+	checked := healthResult{time: sample.Time, latency: sample.Latency}
+	if !sample.Success {
+		checked.err = errors.New(sample.Error)
+	}
+	healthMu.Lock()
+	healthResults[id] = checked
+	healthMu.Unlock()
+}
+
+// 将最近的健康检查结果更新到各分组。成员为分组时，有可用成员即视为可用，延迟取可用成员中最低的
+func feedGroupHealth() {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	var memberHealth func(id string, depth int) (healthResult, bool)
+	memberHealth = func(id string, depth int) (healthResult, bool) {
+		val, ok := OutboundMap.Load(id)
+		if !ok {
+			return healthResult{}, false
+		}
+		g, isGroup := val.(*group.Outbound)
+		if !isGroup {
+			res, ok := healthResults[id]
+			return res, ok
+		}
+		if depth >= maxGroupDepth {
+			return healthResult{}, false
+		}
+		var best healthResult
+		checked := false
+		for _, member := range g.Members() {
+			res, ok := memberHealth(member, depth+1)
+			if !ok {
+				continue
+			}
+			if !checked || (best.err != nil && res.err == nil) || (res.err == nil && res.latency < best.latency) {
+				best = res
+			}
+			checked = true
+		}
+		return best, checked
+	}
+	OutboundMap.Range(func(key, value interface{}) bool {
+		g, isGroup := value.(*group.Outbound)
+		if !isGroup {
+			return true
+		}
+		for _, member := range g.Members() {
+			if res, ok := memberHealth(member, 1); ok {
+				g.SetHealth(member, res.latency, res.err)
+			}
+		}
+		return true
+	})
+}
+
+// GetOutboundStatusByID 根据最近的健康检查样本得出出站代理的当前状态
+func GetOutboundStatusByID(id string) OutboundStatus {
+	status := OutboundStatus{OutboundID: id, Latency: -1}
+	samples, err := StatisticDBM.HealthSample.GetLatest(id, healthFlapWindow)
+	if err != nil || len(samples) == 0 {
+		return status
+	}
+	last := samples[len(samples)-1]
+	status.Checked = true
+	status.Up = last.Success
+	status.Latency = last.Latency
+	status.Error = last.Error
+	status.LastCheck = last.Time
+	status.LastChange = samples[0].Time
+	var transitions, successes int
+	for i, s := range samples {
+		if s.Success {
+			successes++
+		}
+		if i > 0 && s.Success != samples[i-1].Success {
+			transitions++
+			status.LastChange = s.Time
+		}
+	}
+	status.Flapping = transitions >= healthFlapThreshold
+	status.Uptime = float64(successes) / float64(len(samples))
+	return status
+}
+
+// GetOutboundStatus 获取所有出站代理的当前健康状态，按出站代理ID排序
+func GetOutboundStatus() []OutboundStatus {
+	var statuses []OutboundStatus
+	OutboundMap.Range(func(key, value interface{}) bool {
+		if _, isGroup := value.(proxy.Outbound).(*group.Outbound); !isGroup {
+			statuses = append(statuses, GetOutboundStatusByID(key.(string)))
+		}
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].OutboundID < statuses[j].OutboundID
+	})
+	return statuses
+}
@@ -3,11 +3,11 @@ package manager
 import (
 	"errors"
 	"log"
-	"net"
 	"sync"
 	"time"
 
 	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/dns"
 	"github.com/ZIXT233/ziproxy/proxy"
 	"github.com/ZIXT233/ziproxy/utils"
 )
@@ -26,6 +26,9 @@ var (
 	Version          string
 	StartUpTime      time.Time
 	HttpCacheEnable  bool
+	DialAttempts     = 3
+	DialTimeout      = 10 * time.Second
+	Resolver         *dns.Resolver
 )
 
 func SyncInbound(d *db.ProxyData) {
@@ -49,6 +52,7 @@ func SyncOutbound(d *db.ProxyData) {
 	if old, exists := OutboundMap.Load(d.ID); exists {
 		old.(proxy.Outbound).CloseAllConn()
 	}
+	proxy.UnregisterMuxOutbound(d.ID)
 	if d.ID == "block" {
 		return
 	}
@@ -59,28 +63,44 @@ func SyncOutbound(d *db.ProxyData) {
 		return
 	}
 	OutboundMap.Store(d.ID, outbound)
+	wakeHealthMonitor()
 }
 func RemoveOutbound(id string) {
 	if old, exists := OutboundMap.Load(id); exists {
 		old.(proxy.Outbound).CloseAllConn()
 	}
+	proxy.UnregisterMuxOutbound(id)
 	OutboundMap.Delete(id)
+	wakeHealthMonitor()
 }
 func SyncRouteScheme(d *db.RouteScheme) {
+	routeTableMu.Lock()
+	defer routeTableMu.Unlock()
 	RouteSchemeMap.Store(d.ID, d)
+	updateRouteTable(d.ID, compileRouteScheme(d))
 }
 func RemoveRouteScheme(id string) {
+	routeTableMu.Lock()
+	defer routeTableMu.Unlock()
 	RouteSchemeMap.Delete(id)
+	updateRouteTable(id, nil)
 }
 func SyncUser(d *db.User) {
+	//linkToken更换后删除旧的索引
+	if old, ok := UserMap.Load(d.ID); ok && old.(*db.User).LinkToken != d.LinkToken {
+		UserTokenMap.Delete(old.(*db.User).LinkToken)
+	}
 	UserMap.Store(d.ID, d)
 	if d.ID != "forward" && d.ID != "guest" {
 		UserTokenMap.Store(d.LinkToken, d)
 	}
-
+	proxy.LinkTokensChanged()
 }
 func RemoveUser(id string) {
-	UserMap.Delete(id)
+	if old, ok := UserMap.LoadAndDelete(id); ok {
+		UserTokenMap.Delete(old.(*db.User).LinkToken)
+	}
+	proxy.LinkTokensChanged()
 }
 func SyncUserGroup(d *db.UserGroup) {
 	UserGroupMap.Store(d.ID, d)
@@ -89,26 +109,16 @@ func RemoveUserGroup(id string) {
 	UserGroupMap.Delete(id)
 }
 
+// 通过出站代理请求测速地址，返回响应首字节时间(毫秒)
 func MeasureLatency(proxyID string) (int64, error) {
-	if val, exists := OutboundMap.Load(proxyID); exists {
-		outbound := val.(proxy.Outbound)
-		start := time.Now()
-		timeout := 5 * time.Second
-		conn, err := net.DialTimeout("tcp", outbound.Addr(), timeout)
-		if err != nil {
-			return -1, errors.New("failed to connect to outbound")
-		}
-		defer conn.Close()
-		duration := time.Since(start)
-		milliseconds := duration.Milliseconds()
-		target, _ := proxy.NewTargetAddr("baidu.com:80")
-		_, _, err = outbound.WrapConn(conn, target)
-		if err != nil {
-			return -2, errors.New("failed to handshake with outbound")
-		}
-		return milliseconds, nil
+	result, err := ProbeOutbound(proxyID, ProbeOptions{})
+	if err != nil {
+		return -1, err
 	}
-	return 0, errors.New("proxy not found")
+	if !result.Success {
+		return -1, errors.New(result.Error)
+	}
+	return result.TTFBMs, nil
 }
 func TrafficCleanCron() {
 	go func() {
@@ -119,6 +129,7 @@ func TrafficCleanCron() {
 			}
 			beforeTime := time.Now().Add(-time.Duration(sysInfo.TrafficRecordDays) * 24 * time.Hour)
 			StatisticDBM.Traffic.Clean(beforeTime)
+			StatisticDBM.HealthSample.Clean(beforeTime)
 			log.Printf("Traffic records before %s have been cleaned", beforeTime.Format("2006-01-02"))
 			time.Sleep(time.Hour * 24)
 		}
@@ -130,9 +141,6 @@ func UpdateUserToken(id string) (string, error) {
 		log.Printf("Failed to fetch user %s err: %v", id, err)
 		return "", err
 	}
-	if _, exists := UserTokenMap.Load(id); exists {
-		UserTokenMap.Delete(id)
-	}
 	var token string
 	for {
 		token, _ = utils.GenerateBase64RandomString(16)
@@ -164,7 +172,33 @@ func Start(config *utils.RootConfig, version string) {
 	if err != nil {
 		panic(err)
 	}
+	if config.DNS.FakeIPRange != "" {
+		if err := initFakeIP(config.DNS.FakeIPRange); err != nil {
+			log.Fatal("failed to init fake ip pool:", err)
+		}
+	}
 	initRouter(config.StaticPath)
+	Resolver, err = dns.NewResolver(config.DNS.Servers, config.DNS.Hosts, time.Duration(config.DNS.Timeout)*time.Second)
+	if err != nil {
+		log.Fatal("failed to init dns resolver:", err)
+	}
+	proxy.LookupIP = Resolver.LookupIP
+	if config.DialRetry > 0 {
+		DialAttempts = config.DialRetry
+	}
+	if config.ProbeURL != "" {
+		ProbeURL = config.ProbeURL
+	}
+	if config.HealthCheckInterval != 0 {
+		HealthCheckInterval = time.Duration(config.HealthCheckInterval) * time.Second
+	}
+	if config.RuleSetDir != "" {
+		RuleSetDir = config.RuleSetDir
+	}
+	PACGuest = config.PACGuest
+	if config.DialTimeout > 0 {
+		DialTimeout = time.Duration(config.DialTimeout) * time.Second
+	}
 	HttpCacheEnable = true
 	err = InitTlsMITM(config.MITMCACert, config.MITMCAKey)
 	if err != nil {
@@ -190,6 +224,7 @@ func Start(config *utils.RootConfig, version string) {
 
 	users, _, _ := DBM.User.List(0, db.MAX)
 	userGroups, _, _ := DBM.UserGroup.List(0, db.MAX)
+	ruleSets, _, _ := DBM.RuleSet.List(0, db.MAX)
 	routeSchemes, _, _ := DBM.RouteScheme.List(0, db.MAX)
 	inboundData, _, _ := DBM.ProxyData.List(db.InDir, 0, db.MAX)
 	outboundData, _, _ := DBM.ProxyData.List(db.OutDir, 0, db.MAX)
@@ -200,6 +235,10 @@ func Start(config *utils.RootConfig, version string) {
 	for _, d := range userGroups {
 		SyncUserGroup(&d)
 	}
+	//路由方案编译时需要规则集内容，先于路由方案加载
+	for _, d := range ruleSets {
+		SyncRuleSet(&d)
+	}
 	for _, d := range routeSchemes {
 		SyncRouteScheme(&d)
 	}
@@ -210,6 +249,7 @@ func Start(config *utils.RootConfig, version string) {
 		SyncOutbound(&d)
 	}
 	TrafficCleanCron()
+	HealthMonitorCron()
 	StartUpTime = time.Now().Truncate(time.Second)
 	LaunchRealTimeStatistic()
 }
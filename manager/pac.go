@@ -0,0 +1,293 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/metacubex/geo/encoding/singgeo"
+	"github.com/metacubex/geo/encoding/v2raygeo"
+)
+
+var (
+	PACGuest         bool //未携带令牌的PAC/WPAD请求按guest用户生成脚本，可在config.json中通过pac_guest开启
+	geositeFile      string
+	geositeRuleCache sync.Map //geosite代码 -> *pacRule，geosite.dat运行期间不变，展开结果可以复用
+)
+
+// PAC脚本中的一条路由规则，由浏览器按优先级顺序匹配
+type pacRule struct {
+	Direct  bool            `json:"direct"`
+	Any     bool            `json:"any,omitempty"`
+	Full    map[string]bool `json:"full,omitempty"`    //完整域名
+	Suffix  map[string]bool `json:"suffix,omitempty"`  //域名及其子域名
+	Sub     map[string]bool `json:"sub,omitempty"`     //仅子域名
+	Keyword []string        `json:"keyword,omitempty"` //域名关键字
+	Regex   []string        `json:"regex,omitempty"`   //域名正则表达式
+}
+
+const pacTemplate = `var proxy = %q;
+var rules = %s;
+for (var i = 0; i < rules.length; i++) {
+	var regex = [];
+	for (var j = 0; rules[i].regex && j < rules[i].regex.length; j++) {
+		try {
+			regex.push(new RegExp(rules[i].regex[j]));
+		} catch (e) {
+		}
+	}
+	rules[i].regex = regex;
+}
+
+function matchRule(rule, host) {
+	if (rule.any) {
+		return true;
+	}
+	if (rule.full && rule.full.hasOwnProperty(host)) {
+		return true;
+	}
+	if (rule.suffix || rule.sub) {
+		for (var suffix = host; ; suffix = suffix.substring(suffix.indexOf(".") + 1)) {
+			if (rule.suffix && rule.suffix.hasOwnProperty(suffix)) {
+				return true;
+			}
+			if (rule.sub && suffix != host && rule.sub.hasOwnProperty(suffix)) {
+				return true;
+			}
+			if (suffix.indexOf(".") < 0) {
+				break;
+			}
+		}
+	}
+	for (var i = 0; rule.keyword && i < rule.keyword.length; i++) {
+		if (host.indexOf(rule.keyword[i]) >= 0) {
+			return true;
+		}
+	}
+	for (var i = 0; i < rule.regex.length; i++) {
+		if (rule.regex[i].test(host)) {
+			return true;
+		}
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	var ipHost = /^[0-9.]+$/.test(host) || host.indexOf(":") >= 0;
+	for (var i = 0; i < rules.length; i++) {
+		if ((!ipHost || rules[i].any) && matchRule(rules[i], host)) {
+			return rules[i].direct ? "DIRECT" : proxy;
+		}
+	}
+	return proxy;
+}
+`
+
+// 将域名规则中按标签匹配的通配符模式转换为正则表达式，与matchDomain的匹配方式一致
+func domainPatternRegex(pattern string) string {
+	labels := strings.Split(strings.ToLower(pattern), ".")
+	for i, label := range labels {
+		if label == "*" {
+			labels[i] = "[^.]+"
+		} else {
+			labels[i] = regexp.QuoteMeta(label)
+		}
+	}
+	return "^" + strings.Join(labels, "\\.") + "$"
+}
+
+// 读取geosite.dat中指定代码包含的域名列表，兼容sing-geosite与V2Ray格式
+func loadGeositeRule(code string) (*pacRule, error) {
+	code = strings.ToLower(code)
+	if rule, ok := geositeRuleCache.Load(code); ok {
+		return rule.(*pacRule), nil
+	}
+	rule := &pacRule{Full: make(map[string]bool), Suffix: make(map[string]bool)}
+	if reader, codes, err := singgeo.LoadSiteFromFile(geositeFile); err == nil {
+		for _, c := range codes {
+			if !strings.EqualFold(c, code) {
+				continue
+			}
+			items, err := reader.Read(c)
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				switch item.Type {
+				case singgeo.RuleTypeDomain:
+					rule.Full[item.Value] = true
+				case singgeo.RuleTypeDomainSuffix:
+					rule.Suffix[strings.TrimPrefix(item.Value, ".")] = true
+				case singgeo.RuleTypeDomainKeyword:
+					rule.Keyword = append(rule.Keyword, item.Value)
+				case singgeo.RuleTypeDomainRegex:
+					rule.Regex = append(rule.Regex, item.Value)
+				}
+			}
+		}
+	} else {
+		data, err := os.ReadFile(geositeFile)
+		if err != nil {
+			return nil, err
+		}
+		sites, err := v2raygeo.LoadSite(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, site := range sites {
+			if !strings.EqualFold(site.CountryCode, code) {
+				continue
+			}
+			for _, domain := range site.Domain {
+				switch domain.Type {
+				case v2raygeo.Domain_Full:
+					rule.Full[domain.Value] = true
+				case v2raygeo.Domain_Domain:
+					rule.Suffix[domain.Value] = true
+				case v2raygeo.Domain_Plain:
+					rule.Keyword = append(rule.Keyword, domain.Value)
+				case v2raygeo.Domain_Regex:
+					rule.Regex = append(rule.Regex, domain.Value)
+				}
+			}
+		}
+	}
+	geositeRuleCache.Store(code, rule)
+	return rule, nil
+}
+
+// 规则的出站代理全部为直连时，浏览器可以绕过代理直接访问
+func isDirectRule(r db.Rule) bool {
+	if len(r.Outbounds) == 0 {
+		return false
+	}
+	for _, o := range r.Outbounds {
+		outbound, ok := OutboundMap.Load(o.ID)
+		if !ok || !isDirectOutbound(outbound.(proxy.Outbound)) {
+			return false
+		}
+	}
+	return true
+}
+
+// 没有叠加上层协议的direct出站代理
+func isDirectOutbound(outbound proxy.Outbound) bool {
+	return outbound.Scheme() == "direct" && outbound.Config()["upper"] == nil
+}
+
+// 将规则集的域名匹配项展开为PAC规则，返回规则集是否包含无法在浏览器中匹配的CIDR
+func ruleSetPACRule(rule *pacRule, id string) bool {
+	val, ok := RuleSetMap.Load(id)
+	if !ok {
+		return false
+	}
+	data := val.(*ruleSet).load()
+	if data == nil {
+		return false
+	}
+	for _, domain := range data.Full {
+		if strings.Contains(domain, "*") {
+			rule.Regex = append(rule.Regex, domainPatternRegex(domain))
+		} else {
+			rule.Full[strings.ToLower(domain)] = true
+		}
+	}
+	for _, domain := range data.Suffix {
+		rule.Suffix[strings.ToLower(domain)] = true
+	}
+	for _, domain := range data.Subdomain {
+		rule.Sub[strings.ToLower(domain)] = true
+	}
+	for _, keyword := range data.Keyword {
+		rule.Keyword = append(rule.Keyword, strings.ToLower(keyword))
+	}
+	rule.Regex = append(rule.Regex, data.Regex...)
+	return len(data.CIDR) > 0
+}
+
+// GeneratePAC 根据用户组的路由方案生成代理自动配置脚本，路由到直连出站代理的domain、geosite、rule-set规则返回DIRECT，
+// 其余流量均交给proxyDirective指定的http入站代理，由服务端按路由方案处理。
+// ip、geoip规则需要在浏览器中解析域名，端口、来源等规则依赖服务端信息，均不写入脚本，由服务端匹配。
+// 这类规则不是直连时，优先级在其之后的规则在浏览器中的匹配结果可能与服务端不同，因此不再写入脚本，统一交给服务端处理
+func GeneratePAC(userGroupID, proxyDirective string) (string, error) {
+	var rules []db.Rule
+	if userGroup, ok := UserGroupMap.Load(userGroupID); ok {
+		if routeScheme, ok := RouteSchemeMap.Load(userGroup.(*db.UserGroup).RouteSchemeID); ok && routeScheme.(*db.RouteScheme).Enabled {
+			rules = append(rules, routeScheme.(*db.RouteScheme).Rules...)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	pacRules := make([]*pacRule, 0, len(rules))
+	for _, r := range rules {
+		direct := isDirectRule(r)
+		evaluable := true
+		switch r.Type {
+		case RuleAny:
+			pacRules = append(pacRules, &pacRule{Direct: direct, Any: true})
+		case RuleDomain:
+			rule := &pacRule{Direct: direct}
+			for _, pattern := range strings.Split(r.Pattern, ",") {
+				if pattern == "*" {
+					rule.Any = true
+				} else {
+					rule.Regex = append(rule.Regex, domainPatternRegex(pattern))
+				}
+			}
+			pacRules = append(pacRules, rule)
+		case RuleDomainSuffix:
+			rule := &pacRule{Direct: direct, Suffix: make(map[string]bool)}
+			for _, pattern := range strings.Split(r.Pattern, ",") {
+				rule.Suffix[strings.TrimPrefix(pattern, ".")] = true
+			}
+			pacRules = append(pacRules, rule)
+		case RuleDomainKeyword:
+			pacRules = append(pacRules, &pacRule{Direct: direct, Keyword: strings.Split(r.Pattern, ",")})
+		case RuleDomainRegex:
+			pacRules = append(pacRules, &pacRule{Direct: direct, Regex: []string{r.Pattern}})
+		case RuleGeosite:
+			rule := &pacRule{Direct: direct, Full: make(map[string]bool), Suffix: make(map[string]bool)}
+			for _, pattern := range strings.Split(r.Pattern, ",") {
+				site, err := loadGeositeRule(pattern)
+				if err != nil {
+					return "", fmt.Errorf("load geosite %s: %v", pattern, err)
+				}
+				for domain := range site.Full {
+					rule.Full[domain] = true
+				}
+				for domain := range site.Suffix {
+					rule.Suffix[domain] = true
+				}
+				rule.Keyword = append(rule.Keyword, site.Keyword...)
+				rule.Regex = append(rule.Regex, site.Regex...)
+			}
+			pacRules = append(pacRules, rule)
+		case RuleRuleSet:
+			rule := &pacRule{Direct: direct, Full: make(map[string]bool), Suffix: make(map[string]bool), Sub: make(map[string]bool)}
+			for _, id := range strings.Split(r.Pattern, ",") {
+				if ruleSetPACRule(rule, id) {
+					evaluable = false
+				}
+			}
+			pacRules = append(pacRules, rule)
+		default:
+			evaluable = false
+		}
+		if !evaluable && !direct {
+			break
+		}
+	}
+	data, err := json.Marshal(pacRules)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(pacTemplate, proxyDirective, data), nil
+}
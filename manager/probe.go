@@ -0,0 +1,187 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+const (
+	defaultProbeURL      = "http://www.gstatic.com/generate_204"
+	defaultProbeTimeout  = 10 * time.Second
+	defaultDownloadLimit = 10 * time.Second
+)
+
+// 测速使用的默认请求地址，可在config.json中通过probe_url配置
+var ProbeURL = defaultProbeURL
+
+var ErrOutboundNotFound = errors.New("proxy not found")
+
+// ProbeOptions 出站代理测速参数，零值字段使用默认值
+type ProbeOptions struct {
+	URL              string        //延迟测试请求地址，响应内容不做要求
+	DownloadURL      string        //下载测速地址，为空时不进行下载测速
+	Timeout          time.Duration //延迟测试的整体超时
+	DownloadDuration time.Duration //下载测速的最长时间，到时即停止计算吞吐量
+}
+
+// ProbeResult 出站代理测速结果，时间单位为毫秒，吞吐量单位为字节每秒
+type ProbeResult struct {
+	ProxyID       string  `json:"proxyId"`
+	Outbound      string  `json:"outbound"` //实际使用的出站代理，出站代理分组为选中的成员
+	Success       bool    `json:"success"`
+	Error         string  `json:"error,omitempty"`
+	ConnectMs     int64   `json:"connectMs"` //建立连接及完成出站代理握手的时间
+	TTFBMs        int64   `json:"ttfbMs"`    //从发出请求到收到响应首字节的时间，包含建立连接
+	StatusCode    int     `json:"statusCode"`
+	DownloadBytes int64   `json:"downloadBytes,omitempty"`
+	DownloadMs    int64   `json:"downloadMs,omitempty"`
+	Throughput    float64 `json:"throughput,omitempty"`
+}
+
+// 测速连接，关闭时一并释放出站代理注册的关闭消息通道
+type probeConn struct {
+	net.Conn
+	outConn   *ConnWithTimeout
+	outbound  proxy.Outbound
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *probeConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Conn.Close()
+		c.outConn.Close()
+		c.outbound.UnregCloseChan(c.closeChan)
+	})
+	return nil
+}
+
+// 经过完整出站代理链连接addr，返回的连接关闭时释放出站代理资源
+func dialThrough(outbound proxy.Outbound, addr string) (net.Conn, error) {
+	target, err := proxy.NewTargetAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	outConn, wrappedOutConn, outCloseChan, err := dialOutbound(outbound, target, nil, nil)
+	if err != nil {
+		outbound.UnregCloseChan(outCloseChan)
+		return nil, err
+	}
+	return &probeConn{Conn: wrappedOutConn, outConn: outConn, outbound: outbound, closeChan: outCloseChan}, nil
+}
+
+// 经过完整出站代理链发送HTTP请求的客户端，每次请求新建连接，connectTime记录最近一次建立连接的耗时
+func probeClient(outbound proxy.Outbound, timeout time.Duration, connectTime *time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				start := time.Now()
+				conn, err := dialThrough(outbound, addr)
+				if err != nil {
+					return nil, err
+				}
+				*connectTime = time.Since(start)
+				return conn, nil
+			},
+		},
+	}
+}
+
+// ProbeOutbound 通过出站代理发送HTTP请求，测量建立连接时间与响应首字节时间，并可选进行下载测速。
+// 出站代理不存在时返回ErrOutboundNotFound，测速失败记录在结果中
+func ProbeOutbound(proxyID string, opts ProbeOptions) (*ProbeResult, error) {
+	if opts.URL == "" {
+		opts.URL = ProbeURL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProbeTimeout
+	}
+	if opts.DownloadDuration <= 0 {
+		opts.DownloadDuration = defaultDownloadLimit
+	}
+	u, err := url.Parse(opts.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid probe url %s", opts.URL)
+	}
+	target, err := proxy.NewTargetAddr(u.Host)
+	if err != nil {
+		target = &proxy.TargetAddr{Hostname: u.Hostname()}
+	}
+	outbound, ok := resolveOutbound(proxyID, target)
+	if !ok {
+		return nil, ErrOutboundNotFound
+	}
+	result := &ProbeResult{ProxyID: proxyID, Outbound: outbound.Name()}
+
+	var connectTime time.Duration
+	var firstByte time.Time
+	client := probeClient(outbound, opts.Timeout, &connectTime)
+	req, err := http.NewRequest(http.MethodGet, opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}))
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.Success = true
+	result.StatusCode = resp.StatusCode
+	result.ConnectMs = connectTime.Milliseconds()
+	result.TTFBMs = firstByte.Sub(start).Milliseconds()
+
+	if opts.DownloadURL == "" {
+		return result, nil
+	}
+	//下载测速不设整体超时，到达最长时间后按已下载的数据计算吞吐量
+	client = probeClient(outbound, 0, &connectTime)
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DownloadDuration)
+	defer cancel()
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, opts.DownloadURL, nil)
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		return result, nil
+	}
+	start = time.Now()
+	resp, err = client.Do(req)
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	elapsed := time.Since(start)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	result.DownloadBytes = n
+	result.DownloadMs = elapsed.Milliseconds()
+	if elapsed > 0 {
+		result.Throughput = float64(n) / elapsed.Seconds()
+	}
+	return result, nil
+}
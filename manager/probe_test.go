@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	_ "github.com/ZIXT233/ziproxy/proxy/direct"
+)
+
+func TestProbeOutboundDirect(t *testing.T) {
+	payload := bytes.Repeat([]byte("z"), 256*1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	out, err := proxy.OutboundFromConfig("probe-direct", map[string]interface{}{"scheme": "direct"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	OutboundMap.Store("probe-direct", out)
+	defer OutboundMap.Delete("probe-direct")
+
+	result, err := ProbeOutbound("probe-direct", ProbeOptions{
+		URL:              server.URL + "/generate_204",
+		DownloadURL:      server.URL + "/download",
+		Timeout:          5 * time.Second,
+		DownloadDuration: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success {
+		t.Fatalf("probe failed: %s", result.Error)
+	}
+	if result.Outbound != "probe-direct" {
+		t.Errorf("outbound = %s, want probe-direct", result.Outbound)
+	}
+	if result.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", result.StatusCode, http.StatusNoContent)
+	}
+	if result.TTFBMs < 0 || result.TTFBMs < result.ConnectMs {
+		t.Errorf("ttfb = %dms, connect = %dms", result.TTFBMs, result.ConnectMs)
+	}
+	if result.DownloadBytes != int64(len(payload)) {
+		t.Errorf("download bytes = %d, want %d", result.DownloadBytes, len(payload))
+	}
+	if result.Throughput <= 0 {
+		t.Errorf("throughput = %f, want > 0", result.Throughput)
+	}
+}
+
+func TestProbeOutboundNotFound(t *testing.T) {
+	if _, err := ProbeOutbound("probe-missing", ProbeOptions{URL: "http://127.0.0.1:1/"}); err != ErrOutboundNotFound {
+		t.Fatalf("err = %v, want ErrOutboundNotFound", err)
+	}
+}
@@ -1,18 +1,32 @@
 package manager
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ZIXT233/ziproxy/proxy"
 	_ "github.com/ZIXT233/ziproxy/proxy/direct"
+	_ "github.com/ZIXT233/ziproxy/proxy/dns"
+	_ "github.com/ZIXT233/ziproxy/proxy/group"
+	_ "github.com/ZIXT233/ziproxy/proxy/h2"
 	_ "github.com/ZIXT233/ziproxy/proxy/http"
+	_ "github.com/ZIXT233/ziproxy/proxy/mux"
 	_ "github.com/ZIXT233/ziproxy/proxy/raw"
+	_ "github.com/ZIXT233/ziproxy/proxy/redirect"
+	_ "github.com/ZIXT233/ziproxy/proxy/shadowsocks"
+	_ "github.com/ZIXT233/ziproxy/proxy/socks5"
 	_ "github.com/ZIXT233/ziproxy/proxy/tls"
+	_ "github.com/ZIXT233/ziproxy/proxy/trojan"
+	_ "github.com/ZIXT233/ziproxy/proxy/ws"
 )
 
 func addActiveUserLink(userId string) {
@@ -30,8 +44,28 @@ func subActiveUserLink(userId string) {
 }
 
 func InboundProcess(inbound proxy.Inbound) (net.Listener, error) {
+	//DNS服务器入站代理自行监听UDP和TCP，查询由路由方案处理
+	if dnsInbound, ok := inbound.(proxy.DNSInbound); ok {
+		server, err := newDNSServer(inbound)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		return dnsInbound.ServeDNS(server.handle)
+	}
 	//根据入站代理配置监听对应网络地址和端口
-	listener, err := net.Listen("tcp", inbound.Addr())
+	var listener net.Listener
+	var err error
+	if lc, ok := inbound.(proxy.ListenConfigInbound); ok {
+		listener, err = lc.ListenConfig().Listen(context.Background(), "tcp", inbound.Addr())
+	} else {
+		listener, err = net.Listen("tcp", inbound.Addr())
+	}
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	listener, err = wrapProxyProtocolListener(inbound, listener)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -62,116 +96,222 @@ func InboundProcess(inbound proxy.Inbound) (net.Listener, error) {
 					log.Printf("inbound %s recieve %s fail", inbound.Name(), inConn.RemoteAddr().String())
 					return
 				}
-				//通过路由模块进行出站代理匹配
-				outboundName := RouteOutbound(targetAddr, inbound.Name())
-				//通过出站代理ID获取出站代理实例
-				val, ok := OutboundMap.Load(outboundName)
-				if !ok {
-					if outboundName == "block" {
-						log.Printf("Block %s@%s ---> %s\t\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), targetAddr, runtime.NumGoroutine())
-					} else {
-						log.Printf("Outbound %s not found", outboundName)
-					}
-
+				//入站代理返回数据包连接时，按UDP转发处理
+				if packetConn, ok := wrappedInConn.(proxy.PacketConn); ok {
+					packetProcess(inbound, packetConn, targetAddr.UserId, inConn.RemoteAddr().String(), inCloseChan)
 					return
 				}
-				outbound := val.(proxy.Outbound)
-
-				//建立与下一级网络目标的连接
-				var dialAddr string
-				if outbound.Addr() == "direct" {
-					dialAddr = targetAddr.String()
-				} else {
-					dialAddr = outbound.Addr()
-				}
-
-				outConn, err := net.Dial("tcp", dialAddr)
-				if err != nil {
-					log.Println("dial out conn ", err)
+				//入站代理返回多路复用连接时，逐一接收其中的子连接并分别建立流量通道
+				if muxConn, ok := wrappedInConn.(proxy.MuxConn); ok {
+					muxProcess(inbound, muxConn, inCloseChan)
 					return
 				}
+				relay(inbound, inConn, wrappedInConn, targetAddr, inCloseChan)
+			}()
+		}
+	}()
+	return listener, nil
+}
 
-				//连接超时统计模块
-				outConn = createConnWithTimeout(outConn, time.Second*10)
-				defer outConn.Close()
-
-				// 通过出站代理实例对应的包装器函数包装代理流量，从而可对流量进行出站代理协议处理，函数返回包装后IO流
-				wrappedOutConn, outCloseChan, err := outbound.WrapConn(outConn, targetAddr)
-				defer outbound.UnregCloseChan(outCloseChan)
-				if err != nil {
-					log.Println("wrap out conn ", err)
-					return
-				}
+// 在入站连接与出站代理之间建立流量通道并完成转发。inConn为流量通道结束时需要关闭的入站连接，
+// 一般为下层TCP连接，多路复用时为子连接
+func relay(inbound proxy.Inbound, inConn net.Conn, wrappedInConn net.Conn, targetAddr *proxy.TargetAddr, inCloseChan chan struct{}) {
+	//透明代理连接的目标为Fake-IP时还原域名，仍只有IP地址时嗅探首部数据得到域名，供路由匹配使用
+	restoreFakeIP(targetAddr)
+	wrappedInConn, routeAddr := sniffConn(inbound, wrappedInConn, targetAddr)
+	//通过路由模块进行出站代理匹配，建立与下一级网络目标的连接，并通过出站代理实例对应的包装器函数包装代理流量
+	outbound, outConn, wrappedOutConn, outCloseChan, err := dialWithFailover(inbound, targetAddr, routeAddr, inConn)
+	if err != nil {
+		return
+	}
+	defer outbound.UnregCloseChan(outCloseChan)
+	defer outConn.Close()
 
-				commonCloseChan := make(chan struct{})
-				log.Printf("Start %s@%s ---> %s ---> %s\t\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), outbound.Name(), targetAddr, runtime.NumGoroutine())
-				//用于监听关闭信号，及时关闭当前流量通道的协程，确保并发可靠性
-				go func() {
-					var reason string
-					select {
-					case <-outCloseChan:
-						reason = "outbound closed"
-					case <-inCloseChan:
-						reason = "inbound closed"
-					case <-commonCloseChan:
-						if outConn.(*ConnWithTimeout).IsTimeout {
-							reason = "no data transfer in 10s"
-						} else {
-							reason = "transport finished"
-						}
-					}
-					inConn.Close()
-					outConn.Close()
-					log.Printf("End   %s@%s ---> %s ---> %s\t\tdue to %s\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), outbound.Name(), targetAddr, reason, runtime.NumGoroutine())
-				}()
-				//流量统计模块
-				statisticOutConn := StatisticWrap(wrappedOutConn)
-				start_time := time.Now().Truncate(time.Second)
-				//更新用户连接数
-				addActiveUserLink(targetAddr.UserId)
-				//将Inbound侧IO流与Outbound侧IO流进行连接，完成流量转发
-				{
-					tmp, ok := inbound.Config()["use_http_cache"]
-					use_http_cache := false
-					if ok {
-						use_http_cache, _ = tmp.(bool)
-					}
+	commonCloseChan := make(chan struct{})
+	log.Printf("Start %s@%s ---> %s ---> %s\t\tfrom %s\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), outbound.Name(), targetAddr, inConn.RemoteAddr(), runtime.NumGoroutine())
+	//用于监听关闭信号，及时关闭当前流量通道的协程，确保并发可靠性
+	go func() {
+		var reason string
+		select {
+		case <-outCloseChan:
+			reason = "outbound closed"
+		case <-inCloseChan:
+			reason = "inbound closed"
+		case <-commonCloseChan:
+			if outConn.IsTimeout() {
+				reason = "no data transfer in 10s"
+			} else {
+				reason = "transport finished"
+			}
+		}
+		inConn.Close()
+		outConn.Close()
+		log.Printf("End   %s@%s ---> %s ---> %s\t\tdue to %s\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), outbound.Name(), targetAddr, reason, runtime.NumGoroutine())
+	}()
+	//流量统计模块
+	statisticOutConn := StatisticWrap(wrappedOutConn)
+	start_time := time.Now().Truncate(time.Second)
+	//更新用户连接数
+	addActiveUserLink(targetAddr.UserId)
+	//将Inbound侧IO流与Outbound侧IO流进行连接，完成流量转发
+	{
+		tmp, ok := inbound.Config()["use_http_cache"]
+		use_http_cache := false
+		if ok {
+			use_http_cache, _ = tmp.(bool)
+		}
 
-					if use_http_cache {
-						//如果使用HTTP缓存代理
-						//MITM中间人解密模块
-						decryptInConn, isTLS, err := TLS_MITM_to_client(wrappedInConn)
-						if err != nil {
-							log.Println("TLS_MITM_to_client", err)
-							return
-						}
-						decryptOutConn, err := TLS_MITM_to_server(statisticOutConn, targetAddr.Host(), isTLS)
-						if err != nil {
-							log.Println("TLS_MITM_to_server", err)
-							return
-						}
-						//在httpCache模块中完成对两侧流量的解析、缓存和转发
-						httpCache(decryptInConn, decryptOutConn)
-					} else {
-						//如果不使用HTTP缓存代理
-						//建立隧道代理，直接连接两侧IO流
-						go io.Copy(statisticOutConn, wrappedInConn)
-						io.Copy(wrappedInConn, statisticOutConn)
-					}
-				}
-				subActiveUserLink(targetAddr.UserId)
-				//连接正常结束时发送连接正常关闭信号给流量通道关闭协程
-				select {
-				case commonCloseChan <- struct{}{}:
-				default:
-				}
-				//将流量统计信息记录到数据库
-				statisticOutConn.AddToDB(inbound.Name(), outbound.Name(), targetAddr.UserId, targetAddr.String(), start_time)
+		if use_http_cache {
+			//如果使用HTTP缓存代理
+			//MITM中间人解密模块
+			decryptInConn, isTLS, err := TLS_MITM_to_client(wrappedInConn)
+			if err != nil {
+				log.Println("TLS_MITM_to_client", err)
+				return
+			}
+			decryptOutConn, err := TLS_MITM_to_server(statisticOutConn, targetAddr.Host(), isTLS)
+			if err != nil {
+				log.Println("TLS_MITM_to_server", err)
+				return
+			}
+			//在httpCache模块中完成对两侧流量的解析、缓存和转发
+			httpCache(decryptInConn, decryptOutConn)
+		} else {
+			//如果不使用HTTP缓存代理
+			//建立隧道代理，直接连接两侧IO流
+			go io.Copy(statisticOutConn, wrappedInConn)
+			io.Copy(wrappedInConn, statisticOutConn)
+		}
+	}
+	subActiveUserLink(targetAddr.UserId)
+	//连接正常结束时发送连接正常关闭信号给流量通道关闭协程
+	select {
+	case commonCloseChan <- struct{}{}:
+	default:
+	}
+	//将流量统计信息记录到数据库
+	statisticOutConn.AddToDB(inbound.Name(), outbound.Name(), targetAddr.UserId, inConn.RemoteAddr().String(), targetAddr.String(), start_time)
+}
 
-			}()
+// 逐一接收多路复用连接中的子连接，为每条子连接新建协程建立流量通道
+func muxProcess(inbound proxy.Inbound, muxConn proxy.MuxConn, inCloseChan chan struct{}) {
+	sessionEnd := make(chan struct{})
+	defer close(sessionEnd)
+	//入站代理关闭时关闭整个会话
+	go func() {
+		select {
+		case <-inCloseChan:
+			muxConn.Close()
+		case <-sessionEnd:
 		}
 	}()
-	return listener, nil
+	for {
+		streamConn, targetAddr, streamCloseChan, err := muxConn.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer streamConn.Close()
+			defer inbound.UnregCloseChan(streamCloseChan)
+			relay(inbound, streamConn, streamConn, targetAddr, streamCloseChan)
+		}()
+	}
+}
+
+// 建立与下一级网络目标的连接并进行出站代理协议处理，返回用于超时统计和关闭的连接、包装后IO流、已注册的连接关闭消息通道。
+// 出站代理链中含多路复用层时，优先在已有会话上打开子连接；新建的下层连接由会话持有，超时统计和关闭均针对子连接进行。
+// 下层连接为多条代理连接共用时不发送PROXY协议头
+// 按路由匹配的候选出站代理依次拨号，失败时尝试下一个出站代理，最多尝试DialAttempts个，遇到block时停止。
+// routeAddr为路由匹配使用的目标，嗅探到域名而不替换连接目标时与targetAddr不同
+func dialWithFailover(inbound proxy.Inbound, targetAddr, routeAddr *proxy.TargetAddr, inConn net.Conn) (proxy.Outbound, *ConnWithTimeout, net.Conn, chan struct{}, error) {
+	candidates := RouteOutbounds(routeAddr, inbound.Name(), addrIP(inConn.RemoteAddr().String()))
+	if candidates[0] == "block" {
+		log.Printf("Block %s@%s ---> %s\t\tNow Goroutine:%d", targetAddr.UserId, inbound.Name(), targetAddr, runtime.NumGoroutine())
+		return nil, nil, nil, nil, errors.New("blocked")
+	}
+	var attempted []string
+	for _, outboundName := range candidates {
+		if outboundName == "block" || len(attempted) >= DialAttempts {
+			break
+		}
+		//通过出站代理ID获取出站代理实例，出站代理分组解析为实际使用的成员
+		outbound, ok := resolveOutbound(outboundName, routeAddr)
+		if !ok {
+			attempted = append(attempted, outboundName+"(not found)")
+			continue
+		}
+		outConn, wrappedOutConn, outCloseChan, err := dialOutbound(outbound, targetAddr, inConn.RemoteAddr(), inConn.LocalAddr())
+		if err == nil {
+			if len(attempted) > 0 {
+				log.Printf("Dial %s@%s ---> %s succeeded with %s after trying %s", targetAddr.UserId, inbound.Name(), targetAddr, outbound.Name(), strings.Join(attempted, ", "))
+			}
+			return outbound, outConn, wrappedOutConn, outCloseChan, nil
+		}
+		outbound.UnregCloseChan(outCloseChan)
+		attempted = append(attempted, fmt.Sprintf("%s(%v)", outbound.Name(), err))
+	}
+	log.Printf("Dial %s@%s ---> %s failed, tried %s", targetAddr.UserId, inbound.Name(), targetAddr, strings.Join(attempted, ", "))
+	return nil, nil, nil, nil, errors.New("all outbounds failed")
+}
+
+// 单次拨号及出站代理握手，超时时间为DialTimeout。srcAddr、dstAddr为客户端连接的地址，用于PROXY协议头，为nil时发送LOCAL命令
+func dialOutbound(outbound proxy.Outbound, targetAddr *proxy.TargetAddr, srcAddr, dstAddr net.Addr) (*ConnWithTimeout, net.Conn, chan struct{}, error) {
+	mux, isMux := proxy.LoadMuxOutbound(outbound.Name())
+	if isMux {
+		streamConn, outCloseChan, err := mux.OpenStream(targetAddr)
+		if err != nil {
+			return nil, nil, outCloseChan, err
+		}
+		if streamConn != nil {
+			outConn := createConnWithTimeout(streamConn, time.Second*10)
+			return outConn, outConn, outCloseChan, nil
+		}
+	}
+
+	var dialAddr string
+	if outbound.Addr() == "direct" {
+		//直连时由配置的DNS解析器解析目标域名
+		ip, err := targetAddr.ResolveIP()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		dialAddr = net.JoinHostPort(ip.String(), strconv.Itoa(targetAddr.Port))
+	} else {
+		dialAddr = outbound.Addr()
+	}
+	rawConn, err := net.DialTimeout("tcp", dialAddr, DialTimeout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !isMux {
+		if err := writeProxyProtocolHeader(outbound, rawConn, srcAddr, dstAddr); err != nil {
+			rawConn.Close()
+			return nil, nil, nil, err
+		}
+	}
+	//握手阶段设置超时，完成后取消
+	rawConn.SetDeadline(time.Now().Add(DialTimeout))
+	if isMux {
+		streamConn, outCloseChan, err := outbound.WrapConn(rawConn, targetAddr)
+		if err != nil {
+			rawConn.Close()
+			return nil, nil, outCloseChan, err
+		}
+		rawConn.SetDeadline(time.Time{})
+		outConn := createConnWithTimeout(streamConn, time.Second*10)
+		return outConn, outConn, outCloseChan, nil
+	}
+
+	//连接超时统计模块
+	outConn := createConnWithTimeout(rawConn, time.Second*10)
+	// 通过出站代理实例对应的包装器函数包装代理流量，从而可对流量进行出站代理协议处理，函数返回包装后IO流
+	wrappedOutConn, outCloseChan, err := outbound.WrapConn(outConn, targetAddr)
+	if err != nil {
+		outConn.Close()
+		return nil, nil, outCloseChan, err
+	}
+	rawConn.SetDeadline(time.Time{})
+	return outConn, wrappedOutConn, outCloseChan, nil
 }
 
 var InboundProcListenerMap = make(map[string]net.Listener)
@@ -202,33 +342,35 @@ func IsInboundProcRunning(id string) (running bool) {
 	return ok
 }
 
+// 读写与超时检测协程并发访问活跃时间和超时标志，均使用原子变量
 type ConnWithTimeout struct {
 	net.Conn
-	lastActiveTime time.Time
-	nowTime        time.Time
+	lastActiveTime atomic.Int64
+	nowTime        atomic.Int64
 	timeout        time.Duration
-	IsTimeout      bool
+	isTimeout      atomic.Bool
 	tickerStop     chan struct{}
 }
 
 func createConnWithTimeout(conn net.Conn, timeout time.Duration) *ConnWithTimeout {
 	c := &ConnWithTimeout{
-		Conn:           conn,
-		lastActiveTime: time.Now(),
-		nowTime:        time.Now(),
-		timeout:        timeout,
-		IsTimeout:      false,
-		tickerStop:     make(chan struct{}),
+		Conn:       conn,
+		timeout:    timeout,
+		tickerStop: make(chan struct{}),
 	}
+	now := time.Now().UnixNano()
+	c.lastActiveTime.Store(now)
+	c.nowTime.Store(now)
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
 		for {
 			select {
-			case c.nowTime = <-ticker.C:
-				if c.nowTime.Sub(c.lastActiveTime) > c.timeout {
+			case t := <-ticker.C:
+				c.nowTime.Store(t.UnixNano())
+				if time.Duration(t.UnixNano()-c.lastActiveTime.Load()) > c.timeout {
+					c.isTimeout.Store(true)
 					c.Close()
-					c.IsTimeout = true
 					return
 				}
 			case <-c.tickerStop:
@@ -238,15 +380,21 @@ func createConnWithTimeout(conn net.Conn, timeout time.Duration) *ConnWithTimeou
 	}()
 	return c
 }
+
+// IsTimeout 返回连接是否因长时间无数据传输被关闭
+func (c *ConnWithTimeout) IsTimeout() bool {
+	return c.isTimeout.Load()
+}
+
 func (c *ConnWithTimeout) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	c.lastActiveTime = c.nowTime
+	c.lastActiveTime.Store(c.nowTime.Load())
 
 	return n, err
 }
 func (c *ConnWithTimeout) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
-	c.lastActiveTime = c.nowTime
+	c.lastActiveTime.Store(c.nowTime.Load())
 	return n, err
 }
 
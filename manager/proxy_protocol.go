@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"errors"
+	"net"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/pires/go-proxyproto"
+)
+
+// 入站代理配置了proxyProtocol时包装监听器，解析可信来源发送的PROXY协议头(v1/v2)，
+// 此后连接的RemoteAddr即为真实客户端地址；不可信来源的协议头不做解析
+func wrapProxyProtocolListener(inbound proxy.Inbound, listener net.Listener) (net.Listener, error) {
+	config, ok := inbound.Config()["proxyProtocol"].(map[string]interface{})
+	if !ok {
+		return listener, nil
+	}
+	var trusted []string
+	list, _ := config["trusted"].([]interface{})
+	for _, v := range list {
+		if cidr, ok := v.(string); ok {
+			trusted = append(trusted, cidr)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.New("proxyProtocol trusted is required")
+	}
+	policy, err := proxyproto.LaxWhiteListPolicy(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyproto.Listener{Listener: listener, Policy: policy}, nil
+}
+
+// 出站代理配置了proxyProtocol(1或2)时，在下层连接上首先发送PROXY协议头，向下一级传递真实客户端地址
+func writeProxyProtocolHeader(outbound proxy.Outbound, conn net.Conn, srcAddr, dstAddr net.Addr) error {
+	version, ok := outbound.Config()["proxyProtocol"].(float64)
+	if !ok {
+		return nil
+	}
+	if version != 1 && version != 2 {
+		return errors.New("proxyProtocol version must be 1 or 2")
+	}
+	header := proxyproto.HeaderProxyFromAddrs(byte(version), srcAddr, dstAddr)
+	_, err := header.WriteTo(conn)
+	return err
+}
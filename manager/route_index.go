@@ -0,0 +1,203 @@
+package manager
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// 域名后缀树，按从顶级域名开始的标签逐级存储，节点上记录以该节点结尾的规则序号
+type domainTrie struct {
+	children map[string]*domainTrie
+	suffix   []int //域名及其子域名
+	sub      []int //仅子域名
+	full     []int //完整域名
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+func (t *domainTrie) node(domain string) *domainTrie {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	n := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = newDomainTrie()
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (t *domainTrie) insertSuffix(domain string, rule int) {
+	n := t.node(domain)
+	n.suffix = append(n.suffix, rule)
+}
+
+func (t *domainTrie) insertSubdomain(domain string, rule int) {
+	n := t.node(domain)
+	n.sub = append(n.sub, rule)
+}
+
+// 插入完整域名，*标签匹配任意单个标签
+func (t *domainTrie) insertFull(domain string, rule int) {
+	n := t.node(domain)
+	n.full = append(n.full, rule)
+}
+
+// 查找匹配域名的规则序号，耗时只与域名标签数有关
+func (t *domainTrie) lookup(domain string, hits []int) []int {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	return t.walk(labels, len(labels)-1, hits)
+}
+
+func (t *domainTrie) walk(labels []string, i int, hits []int) []int {
+	if i < 0 {
+		return append(hits, t.full...)
+	}
+	for _, key := range []string{labels[i], "*"} {
+		if child, ok := t.children[key]; ok {
+			hits = append(hits, child.suffix...)
+			if i > 0 {
+				hits = append(hits, child.sub...)
+			}
+			hits = child.walk(labels, i-1, hits)
+		}
+	}
+	return hits
+}
+
+// 查找域名匹配rule的索引项，返回对应的匹配项，供路由模拟说明匹配原因
+func (t *domainTrie) explain(domain string, rule int) (string, bool) {
+	labels := strings.Split(strings.ToLower(domain), ".")
+	return t.explainWalk(labels, len(labels)-1, nil, rule)
+}
+
+func (t *domainTrie) explainWalk(labels []string, i int, path []string, rule int) (string, bool) {
+	if i < 0 {
+		return joinReversed(path), slices.Contains(t.full, rule)
+	}
+	for _, key := range []string{labels[i], "*"} {
+		child, ok := t.children[key]
+		if !ok {
+			continue
+		}
+		path := append(slices.Clip(path), key)
+		if slices.Contains(child.suffix, rule) {
+			return joinReversed(path), true
+		}
+		if i > 0 && slices.Contains(child.sub, rule) {
+			return "." + joinReversed(path), true
+		}
+		if pattern, ok := child.explainWalk(labels, i-1, path, rule); ok {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// 按从顶级域名开始的标签还原域名
+func joinReversed(labels []string) string {
+	reversed := slices.Clone(labels)
+	slices.Reverse(reversed)
+	return strings.Join(reversed, ".")
+}
+
+// 按位存储的CIDR前缀树，IPv4与IPv6分别存储，查找时收集路径上所有前缀的规则序号
+type cidrTree struct {
+	v4 *cidrNode
+	v6 *cidrNode
+}
+
+type cidrNode struct {
+	child [2]*cidrNode
+	rules []int
+}
+
+func newCIDRTree() *cidrTree {
+	return &cidrTree{v4: &cidrNode{}, v6: &cidrNode{}}
+}
+
+// 插入IP、CIDR或*(任意地址)
+func (t *cidrTree) insert(pattern string, rule int) {
+	if pattern == "*" {
+		t.v4.rules = append(t.v4.rules, rule)
+		t.v6.rules = append(t.v6.rules, rule)
+		return
+	}
+	var ip net.IP
+	var ones int
+	if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+		ip = cidr.IP
+		ones, _ = cidr.Mask.Size()
+	} else if ip = net.ParseIP(pattern); ip != nil {
+		ones = 128
+		if ip.To4() != nil {
+			ones = 32
+		}
+	} else {
+		return
+	}
+	n := t.v6
+	if ip4 := ip.To4(); ip4 != nil && ones <= 32 {
+		ip, n = ip4, t.v4
+	} else if ip4 != nil && len(ip) == net.IPv6len && ones >= 96 {
+		//IPv4映射的IPv6前缀，查找时IPv4地址在IPv4树中查找
+		ip, n, ones = ip4, t.v4, ones-96
+	} else {
+		ip = ip.To16()
+	}
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &cidrNode{}
+		}
+		n = n.child[bit]
+	}
+	n.rules = append(n.rules, rule)
+}
+
+func (t *cidrTree) lookup(ip net.IP, hits []int) []int {
+	if ip == nil {
+		return hits
+	}
+	n := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, n = ip4, t.v4
+	}
+	for i := 0; n != nil; i++ {
+		hits = append(hits, n.rules...)
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.child[ip[i/8]>>(7-i%8)&1]
+	}
+	return hits
+}
+
+// 查找地址匹配rule的前缀，返回对应的CIDR，*匹配任意地址，供路由模拟说明匹配原因
+func (t *cidrTree) explain(ip net.IP, rule int) (string, bool) {
+	if ip == nil {
+		return "", false
+	}
+	n := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, n = ip4, t.v4
+	}
+	for i := 0; n != nil; i++ {
+		if slices.Contains(n.rules, rule) {
+			if i == 0 {
+				return "*", true
+			}
+			return (&net.IPNet{IP: ip.Mask(net.CIDRMask(i, len(ip)*8)), Mask: net.CIDRMask(i, len(ip)*8)}).String(), true
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		n = n.child[ip[i/8]>>(7-i%8)&1]
+	}
+	return "", false
+}
@@ -0,0 +1,236 @@
+package manager
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+func TestDomainTrie(t *testing.T) {
+	trie := newDomainTrie()
+	trie.insertFull("example.com", 0)
+	trie.insertSuffix("google.com", 1)
+	trie.insertSubdomain("github.com", 2)
+	trie.insertFull("*.cdn.net", 3)
+	trie.insertFull("api.*.org", 4)
+	trie.insertSuffix("com", 5)
+
+	tests := []struct {
+		domain string
+		want   []int
+	}{
+		{"example.com", []int{0, 5}},
+		{"www.example.com", []int{5}},
+		{"EXAMPLE.com", []int{0, 5}},
+		{"google.com", []int{1, 5}},
+		{"mail.google.com", []int{1, 5}},
+		{"notgoogle.com", []int{5}},
+		{"github.com", []int{5}},
+		{"api.github.com", []int{2, 5}},
+		{"a.cdn.net", []int{3}},
+		{"cdn.net", nil},
+		{"a.b.cdn.net", nil},
+		{"api.foo.org", []int{4}},
+		{"web.foo.org", nil},
+		{"example.org", nil},
+	}
+	for _, tt := range tests {
+		got := trie.lookup(tt.domain, nil)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("lookup(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestCIDRTree(t *testing.T) {
+	tree := newCIDRTree()
+	tree.insert("10.0.0.0/8", 0)
+	tree.insert("10.1.0.0/16", 1)
+	tree.insert("192.168.1.1", 2)
+	tree.insert("2001:db8::/32", 3)
+	tree.insert("*", 4)
+	tree.insert("::ffff:172.16.0.0/108", 5)
+	tree.insert("invalid", 6)
+
+	tests := []struct {
+		ip   string
+		want []int
+	}{
+		{"10.2.3.4", []int{0, 4}},
+		{"10.1.3.4", []int{0, 1, 4}},
+		{"192.168.1.1", []int{2, 4}},
+		{"192.168.1.2", []int{4}},
+		{"2001:db8::1", []int{3, 4}},
+		{"2001:db9::1", []int{4}},
+		{"172.16.0.1", []int{4, 5}},
+		{"8.8.8.8", []int{4}},
+	}
+	for _, tt := range tests {
+		got := tree.lookup(net.ParseIP(tt.ip), nil)
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("lookup(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if got := tree.lookup(nil, nil); got != nil {
+		t.Errorf("lookup(nil) = %v, want nil", got)
+	}
+}
+
+// 替换域名解析函数，记录解析次数
+func stubLookupIP(t *testing.T, ip string) *int {
+	count := new(int)
+	lookup := proxy.LookupIP
+	proxy.LookupIP = func(host string) ([]net.IP, error) {
+		*count++
+		return []net.IP{net.ParseIP(ip)}, nil
+	}
+	t.Cleanup(func() { proxy.LookupIP = lookup })
+	return count
+}
+
+func TestMatchResolvesLazily(t *testing.T) {
+	resolves := stubLookupIP(t, "10.0.0.1")
+	cs := compileRouteScheme(&db.RouteScheme{Enabled: true, Rules: []db.Rule{
+		{Type: RuleDomainSuffix, Pattern: "example.com", Priority: 1},
+		{Type: RuleIP, Pattern: "10.0.0.0/8", Priority: 2},
+		{Type: RuleDomain, Pattern: "late.example.org", Priority: 3},
+		{Type: RuleAny, Priority: 4},
+	}})
+
+	target := &proxy.TargetAddr{Hostname: "www.example.com", Port: 443}
+	if got := cs.match(target, "", nil, resolveTarget); !slices.Equal(got, []int{0, 3}) {
+		t.Errorf("match = %v, want [0 3]", got)
+	}
+	if *resolves != 0 || target.IP != nil {
+		t.Errorf("resolved %d times after a domain rule matched", *resolves)
+	}
+
+	target = &proxy.TargetAddr{Hostname: "late.example.org", Port: 443}
+	if got := cs.match(target, "", nil, resolveTarget); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("match = %v, want [1 2 3]", got)
+	}
+	if *resolves != 1 {
+		t.Errorf("resolved %d times, want 1", *resolves)
+	}
+}
+
+func TestMatchNoResolve(t *testing.T) {
+	stubLookupIP(t, "10.0.0.1")
+	cs := compileRouteScheme(&db.RouteScheme{Enabled: true, Rules: []db.Rule{
+		{Type: RuleIP, Pattern: "10.0.0.0/8", Priority: 1, NoResolve: true},
+		{Type: RuleIP, Pattern: "10.0.0.0/8", Priority: 2},
+	}})
+	target := &proxy.TargetAddr{Hostname: "intranet.test", Port: 80}
+	if got := cs.match(target, "", nil, resolveTarget); !slices.Equal(got, []int{1}) {
+		t.Errorf("match = %v, want [1]", got)
+	}
+	target = &proxy.TargetAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+	if got := cs.match(target, "", nil, resolveTarget); !slices.Equal(got, []int{0, 1}) {
+		t.Errorf("match = %v, want [0 1]", got)
+	}
+	//不提供解析函数时域名目标不匹配ip规则
+	target = &proxy.TargetAddr{Hostname: "intranet.test", Port: 53}
+	if got := cs.match(target, "", nil, nil); len(got) != 0 || target.IP != nil {
+		t.Errorf("match = %v, ip = %v without resolver", got, target.IP)
+	}
+}
+
+// 路由方案更新时整体替换编译结果，并发匹配不会读到部分更新的索引
+func TestRouteTableSwap(t *testing.T) {
+	scheme := func(outbound string) *db.RouteScheme {
+		return &db.RouteScheme{ID: "swap-test", Enabled: true, Rules: []db.Rule{
+			{Type: RuleDomainSuffix, Pattern: "example.com", Outbounds: []db.ProxyData{{ID: outbound}}},
+		}}
+	}
+	SyncRouteScheme(scheme("a"))
+	defer RemoveRouteScheme("swap-test")
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cs, ok := loadCompiledScheme("swap-test")
+				if !ok {
+					t.Error("scheme missing during swap")
+					return
+				}
+				hits := cs.match(&proxy.TargetAddr{Hostname: "www.example.com"}, "", nil, resolveTarget)
+				if len(hits) != 1 {
+					t.Errorf("match = %v during swap", hits)
+					return
+				}
+				if id := cs.rules[hits[0]].Outbounds[0]; id != "a" && id != "b" {
+					t.Errorf("outbound = %s during swap", id)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		SyncRouteScheme(scheme([]string{"a", "b"}[i%2]))
+	}
+	close(stop)
+	wg.Wait()
+
+	SyncRouteScheme(scheme("b"))
+	cs, _ := loadCompiledScheme("swap-test")
+	if id := cs.rules[0].Outbounds[0]; id != "b" {
+		t.Errorf("outbound after swap = %s, want b", id)
+	}
+	RemoveRouteScheme("swap-test")
+	if _, ok := loadCompiledScheme("swap-test"); ok {
+		t.Error("scheme still present after removal")
+	}
+}
+
+// 构造指定数量规则的路由方案，域名、IP规则各占一半，最后一条为any规则
+func benchmarkScheme(n int) *db.RouteScheme {
+	rules := make([]db.Rule, 0, n)
+	for i := 0; i < n-1; i++ {
+		r := db.Rule{Priority: uint(i), Outbounds: []db.ProxyData{{ID: fmt.Sprintf("out%d", i%8)}}}
+		if i%2 == 0 {
+			r.Type, r.Pattern = RuleDomainSuffix, fmt.Sprintf("site%d.example.com", i)
+		} else {
+			r.Type, r.Pattern = RuleIP, fmt.Sprintf("10.%d.%d.0/24", i>>8&0xff, i&0xff)
+		}
+		rules = append(rules, r)
+	}
+	rules = append(rules, db.Rule{Type: RuleAny, Priority: uint(n), Outbounds: []db.ProxyData{{ID: "direct"}}})
+	return &db.RouteScheme{ID: "bench", Enabled: true, Rules: rules}
+}
+
+func BenchmarkRouteOutbound(b *testing.B) {
+	UserGroupMap.Store("bench", &db.UserGroup{ID: "bench", RouteSchemeID: "bench", AvailInbounds: []db.ProxyData{{ID: "in"}}})
+	UserMap.Store("bench", &db.User{ID: "bench", UserGroupID: "bench"})
+	defer UserGroupMap.Delete("bench")
+	defer UserMap.Delete("bench")
+	defer RemoveRouteScheme("bench")
+	lookup := proxy.LookupIP
+	proxy.LookupIP = func(host string) ([]net.IP, error) { return []net.IP{net.IPv4(10, 0, 0, 1)}, nil }
+	defer func() { proxy.LookupIP = lookup }()
+
+	for _, n := range []int{100, 10000, 50000} {
+		SyncRouteScheme(benchmarkScheme(n))
+		b.Run(fmt.Sprintf("rules=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				target := &proxy.TargetAddr{Hostname: fmt.Sprintf("site%d.example.com", i%n), Port: 443, UserId: "bench"}
+				RouteOutbound(target, "in", nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// RuleTrace 路由规则的匹配结果
+type RuleTrace struct {
+	ID        uint     `json:"id"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Pattern   string   `json:"pattern"`
+	Priority  uint     `json:"priority"`
+	Outbounds []string `json:"outbounds"`
+	Matched   bool     `json:"matched"`
+	Reason    string   `json:"reason"`
+}
+
+// RouteTrace 路由模拟结果，Reason说明在匹配规则之前即被阻止或不能确定出站代理的原因
+type RouteTrace struct {
+	Target           string      `json:"target"`
+	Hostname         string      `json:"hostname,omitempty"`
+	IP               string      `json:"ip,omitempty"`
+	WouldResolve     bool        `json:"wouldResolve"` //实际路由时需要在本地解析域名目标，未设置resolve时不解析，依赖解析结果的规则视为不匹配，不给出最终出站代理
+	UserGroup        string      `json:"userGroup,omitempty"`
+	RouteScheme      string      `json:"routeScheme,omitempty"`
+	GeositeCodes     []string    `json:"geositeCodes"`
+	GeoipCodes       []string    `json:"geoipCodes"`
+	Rules            []RuleTrace `json:"rules"`
+	MatchedRule      *RuleTrace  `json:"matchedRule,omitempty"` //首个匹配的规则
+	Candidates       []string    `json:"candidates"`            //按优先级排列的候选出站代理，首个匹配规则内的出站代理按配置顺序排列
+	Outbound         string      `json:"outbound"`
+	ResolvedOutbound string      `json:"resolvedOutbound,omitempty"` //出站代理分组选中的成员
+	Reason           string      `json:"reason,omitempty"`
+}
+
+// 解析模拟路由的目标，支持host:port和URL，URL未指定端口时按协议使用默认端口
+func parseTraceDestination(destination string) (*proxy.TargetAddr, error) {
+	if strings.Contains(destination, "://") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return nil, err
+		}
+		port := u.Port()
+		if port == "" {
+			switch u.Scheme {
+			case "http", "ws":
+				port = "80"
+			case "https", "wss":
+				port = "443"
+			default:
+				return nil, fmt.Errorf("unknown port for scheme %s", u.Scheme)
+			}
+		}
+		destination = net.JoinHostPort(u.Hostname(), port)
+	}
+	target, err := proxy.NewTargetAddr(destination)
+	if err != nil {
+		return nil, err
+	}
+	if target.Port <= 0 || target.Port > 65535 {
+		return nil, errors.New("invalid port " + strconv.Itoa(target.Port))
+	}
+	return target, nil
+}
+
+// TraceRoute 模拟RouteOutbounds的路由过程，返回匹配使用的地理信息、每条规则的匹配结果及原因和最终选择的出站代理，不建立连接。
+// source为客户端地址，供src-ip规则匹配，可以为空；resolve为true时与实际路由一样在需要时解析域名目标，否则不解析
+func TraceRoute(userID, inboundID, destination, source string, resolve bool) (*RouteTrace, error) {
+	target, err := parseTraceDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	target.UserId = userID
+	srcIP := addrIP(source)
+	if source != "" && srcIP == nil {
+		return nil, fmt.Errorf("invalid source address %s", source)
+	}
+	restoreFakeIP(target)
+	trace := &RouteTrace{Target: target.String(), Hostname: target.Hostname, GeositeCodes: []string{}, GeoipCodes: []string{}, Rules: []RuleTrace{}, Candidates: []string{}, Outbound: "block"}
+
+	user, ok := UserMap.Load(userID)
+	if !ok {
+		trace.Reason = "用户不存在"
+		return trace, nil
+	}
+	userGroup, ok := UserGroupMap.Load(user.(*db.User).UserGroupID)
+	if !ok {
+		trace.Reason = "用户组不存在"
+		return trace, nil
+	}
+	trace.UserGroup = userGroup.(*db.UserGroup).ID
+	if !slices.ContainsFunc(userGroup.(*db.UserGroup).AvailInbounds, func(inbound db.ProxyData) bool {
+		return inbound.ID == inboundID
+	}) {
+		trace.Reason = "入站代理不在用户组的可用范围内"
+		return trace, nil
+	}
+	trace.RouteScheme = userGroup.(*db.UserGroup).RouteSchemeID
+	scheme, ok := loadCompiledScheme(trace.RouteScheme)
+	if !ok {
+		trace.Reason = "路由方案不存在"
+		return trace, nil
+	}
+	if !scheme.enabled {
+		trace.Reason = "路由方案已禁用"
+		return trace, nil
+	}
+
+	matched := scheme.match(target, inboundID, srcIP, func(t *proxy.TargetAddr) bool {
+		trace.WouldResolve = true
+		return resolve && resolveTarget(t)
+	})
+	unresolved := trace.WouldResolve && !resolve
+	resolveFailed := trace.WouldResolve && resolve && target.IP == nil
+	if target.Hostname != "" {
+		trace.GeositeCodes = append(trace.GeositeCodes, siteDb.LookupCodes(target.Hostname)...)
+	} else {
+		trace.GeositeCodes = append(trace.GeositeCodes, ipDb.LookupCode(target.IP)...)
+	}
+	if target.IP != nil {
+		trace.IP = target.IP.String()
+		trace.GeoipCodes = append(trace.GeoipCodes, ipDb.LookupCode(target.IP)...)
+	}
+
+	for i, r := range scheme.rules {
+		rt := RuleTrace{ID: r.ID, Name: r.Name, Type: r.Type, Pattern: r.Pattern, Priority: r.Priority, Outbounds: r.Outbounds}
+		rt.Matched = slices.Contains(matched, i)
+		if rt.Matched {
+			rt.Reason = scheme.explainMatch(i, target, inboundID, srcIP)
+		} else {
+			rt.Reason = explainMismatch(r, target, srcIP, unresolved, resolveFailed)
+		}
+		trace.Rules = append(trace.Rules, rt)
+		if rt.Matched {
+			for _, id := range r.Outbounds {
+				if !slices.Contains(trace.Candidates, id) {
+					trace.Candidates = append(trace.Candidates, id)
+				}
+			}
+		}
+	}
+	//未解析时依赖解析结果的规则可能匹配，不能确定最终的规则与出站代理
+	if unresolved {
+		trace.Outbound = ""
+		trace.Reason = "路由结果依赖域名目标的本地解析，模拟时未解析，可以设置resolve或以IP作为目标再次模拟"
+		return trace, nil
+	}
+	for i := range trace.Rules {
+		if trace.Rules[i].Matched {
+			trace.MatchedRule = &trace.Rules[i]
+			break
+		}
+	}
+	if len(trace.Candidates) == 0 {
+		trace.Reason = "没有匹配的路由规则"
+		return trace, nil
+	}
+	trace.Outbound = trace.Candidates[0]
+	if trace.Outbound != "block" {
+		if outbound, ok := resolveOutbound(trace.Outbound, target); ok && outbound.Name() != trace.Outbound {
+			trace.ResolvedOutbound = outbound.Name()
+		}
+	}
+	return trace, nil
+}
+
+// 说明规则不匹配的原因，unresolved为实际路由时会解析而模拟时未解析域名目标，resolveFailed为解析域名目标失败
+func explainMismatch(r *compiledRule, target *proxy.TargetAddr, srcIP net.IP, unresolved, resolveFailed bool) string {
+	switch r.Type {
+	case RuleDomain, RuleDomainSuffix, RuleDomainKeyword, RuleDomainRegex:
+		if target.Hostname == "" {
+			return "目标不是域名"
+		}
+	case RuleIP, RuleGeoip, RuleRuleSet:
+		if target.IP != nil || (r.Type == RuleRuleSet && !r.needResolve) {
+			break
+		}
+		switch {
+		case r.NoResolve:
+			return "设置了noResolve，域名目标不在本地解析"
+		case resolveFailed:
+			return "域名目标解析失败"
+		case unresolved && r.Type == RuleRuleSet:
+			return "域名没有匹配，规则集中的CIDR需要在本地解析域名目标，模拟时未解析"
+		case unresolved:
+			return "需要在本地解析域名目标，模拟时未解析"
+		case r.Type != RuleRuleSet:
+			return "优先级更高的规则已匹配，不解析域名目标"
+		}
+	case RuleSrcIP:
+		if srcIP == nil {
+			return "未提供客户端地址"
+		}
+	}
+	if r.Type == RuleRuleSet {
+		for _, id := range strings.Split(r.Pattern, ",") {
+			if val, ok := RuleSetMap.Load(id); !ok || val.(*ruleSet).load() == nil {
+				return "规则集" + id + "未加载"
+			}
+		}
+	}
+	return "没有匹配项与目标匹配"
+}
+
+// 从编译后的索引中找出使规则i匹配的匹配项，说明匹配原因
+func (cs *compiledScheme) explainMatch(i int, target *proxy.TargetAddr, inboundName string, srcIP net.IP) string {
+	if cs.rules[i].Type == RuleAny {
+		return "匹配所有流量"
+	}
+	matchedBy := func(item string) string {
+		return "匹配项" + item + "与目标匹配"
+	}
+	if slices.Contains(cs.always, i) {
+		return matchedBy("*")
+	}
+	host := strings.ToLower(target.Hostname)
+	if host != "" {
+		if pattern, ok := cs.domains.explain(host, i); ok {
+			return matchedBy(pattern)
+		}
+		for _, k := range cs.keywords {
+			if k.rule == i && strings.Contains(host, k.value) {
+				return matchedBy(k.value)
+			}
+		}
+		for _, re := range cs.regexes {
+			if re.rule == i && re.value.MatchString(target.Hostname) {
+				return matchedBy(re.value.String())
+			}
+		}
+	}
+	if len(cs.geosite) > 0 {
+		var geoCodes []string
+		if host != "" {
+			geoCodes = siteDb.LookupCodes(host)
+		} else {
+			geoCodes = ipDb.LookupCode(target.IP)
+		}
+		for _, code := range geoCodes {
+			if slices.Contains(cs.geosite[code], i) {
+				return matchedBy(code)
+			}
+		}
+	}
+	if target.IP != nil {
+		if pattern, ok := cs.ips.explain(target.IP, i); ok {
+			return matchedBy(pattern)
+		}
+		if len(cs.geoip) > 0 {
+			for _, code := range ipDb.LookupCode(target.IP) {
+				if slices.Contains(cs.geoip[code], i) {
+					return matchedBy(code)
+				}
+			}
+		}
+	}
+	if pattern, ok := cs.srcIPs.explain(srcIP, i); ok {
+		return matchedBy(pattern)
+	}
+	for _, p := range cs.ports {
+		if p.rule == i && target.Port >= p.value[0] && target.Port <= p.value[1] {
+			if p.value[0] == p.value[1] {
+				return matchedBy(strconv.Itoa(p.value[0]))
+			}
+			return matchedBy(fmt.Sprintf("%d-%d", p.value[0], p.value[1]))
+		}
+	}
+	if slices.Contains(cs.inbounds[inboundName], i) {
+		return matchedBy(inboundName)
+	}
+	if slices.Contains(cs.users[target.UserId], i) {
+		return matchedBy(target.UserId)
+	}
+	return "匹配"
+}
@@ -0,0 +1,116 @@
+package manager
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/metacubex/geo/geoip"
+	"github.com/metacubex/geo/geosite"
+)
+
+// 使用空的地理信息数据库，测试不依赖geosite.dat和geoip.dat
+func stubGeoDatabases(t *testing.T) {
+	sites, ips := siteDb, ipDb
+	siteDb, _ = geosite.FromBytes(nil)
+	ipDb, _ = geoip.FromBytes(nil)
+	t.Cleanup(func() { siteDb, ipDb = sites, ips })
+}
+
+func TestTraceRouteDryRun(t *testing.T) {
+	stubGeoDatabases(t)
+	resolves := stubLookupIP(t, "10.0.0.1")
+	SyncRouteScheme(&db.RouteScheme{ID: "trace-test", Enabled: true, Rules: []db.Rule{
+		{Type: RuleDomainSuffix, Pattern: "example.com,example.org", Priority: 1, Outbounds: []db.ProxyData{{ID: "proxy"}}},
+		{Type: RuleIP, Pattern: "192.168.0.0/16,10.0.0.0/8", Priority: 2, Outbounds: []db.ProxyData{{ID: "direct"}}},
+		{Type: RuleDstPort, Pattern: "80,443", Priority: 3, Outbounds: []db.ProxyData{{ID: "proxy"}}},
+		{Type: RuleAny, Priority: 4, Outbounds: []db.ProxyData{{ID: "block"}}},
+	}})
+	UserGroupMap.Store("trace-test", &db.UserGroup{ID: "trace-test", RouteSchemeID: "trace-test", AvailInbounds: []db.ProxyData{{ID: "in"}}})
+	UserMap.Store("trace-test", &db.User{ID: "trace-test", UserGroupID: "trace-test"})
+	defer RemoveRouteScheme("trace-test")
+	defer UserGroupMap.Delete("trace-test")
+	defer UserMap.Delete("trace-test")
+
+	trace, err := TraceRoute("trace-test", "in", "https://www.example.org", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.WouldResolve || trace.Outbound != "proxy" {
+		t.Errorf("wouldResolve = %v, outbound = %s", trace.WouldResolve, trace.Outbound)
+	}
+	if got := trace.Rules[0].Reason; got != "匹配项example.org与目标匹配" {
+		t.Errorf("domain rule reason = %s", got)
+	}
+	if got := trace.Rules[2].Reason; got != "匹配项443与目标匹配" {
+		t.Errorf("port rule reason = %s", got)
+	}
+
+	trace, err = TraceRoute("trace-test", "in", "intranet.test:22", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resolves != 0 {
+		t.Errorf("trace resolved %d times, want 0", *resolves)
+	}
+	if !trace.WouldResolve || trace.IP != "" || trace.Rules[1].Matched {
+		t.Errorf("wouldResolve = %v, ip = %s, ip rule matched = %v", trace.WouldResolve, trace.IP, trace.Rules[1].Matched)
+	}
+	//未解析时不给出可能错误的出站代理
+	if trace.Outbound != "" || trace.MatchedRule != nil || trace.Reason == "" {
+		t.Errorf("unresolved trace outbound = %q, matchedRule = %v, reason = %q", trace.Outbound, trace.MatchedRule, trace.Reason)
+	}
+
+	trace, err = TraceRoute("trace-test", "in", "intranet.test:22", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resolves != 1 || trace.IP != "10.0.0.1" {
+		t.Errorf("resolved %d times, ip = %s", *resolves, trace.IP)
+	}
+	if trace.Outbound != "direct" || trace.MatchedRule == nil || trace.MatchedRule.Type != RuleIP {
+		t.Errorf("resolved trace outbound = %s, matchedRule = %v", trace.Outbound, trace.MatchedRule)
+	}
+
+	trace, err = TraceRoute("trace-test", "in", "10.1.2.3:22", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trace.Rules[1].Reason; got != "匹配项10.0.0.0/8与目标匹配" || trace.Outbound != "direct" {
+		t.Errorf("ip rule reason = %s, outbound = %s", got, trace.Outbound)
+	}
+}
+
+func TestDomainTrieExplain(t *testing.T) {
+	trie := newDomainTrie()
+	trie.insertFull("api.*.org", 0)
+	trie.insertSuffix("google.com", 1)
+	trie.insertSubdomain("github.com", 2)
+	tests := []struct {
+		domain string
+		rule   int
+		want   string
+	}{
+		{"api.foo.org", 0, "api.*.org"},
+		{"mail.google.com", 1, "google.com"},
+		{"api.github.com", 2, ".github.com"},
+	}
+	for _, tt := range tests {
+		if got, ok := trie.explain(tt.domain, tt.rule); !ok || got != tt.want {
+			t.Errorf("explain(%s, %d) = %s, %v, want %s", tt.domain, tt.rule, got, ok, tt.want)
+		}
+	}
+	if _, ok := trie.explain("github.com", 2); ok {
+		t.Error("subdomain rule should not match the domain itself")
+	}
+
+	tree := newCIDRTree()
+	tree.insert("10.0.0.0/8", 0)
+	tree.insert("*", 1)
+	if got, _ := tree.explain(net.ParseIP("10.1.2.3"), 0); got != "10.0.0.0/8" {
+		t.Errorf("cidr explain = %s", got)
+	}
+	if got, _ := tree.explain(net.ParseIP("2001:db8::1"), 1); got != "*" {
+		t.Errorf("cidr explain = %s", got)
+	}
+}
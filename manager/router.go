@@ -1,11 +1,17 @@
 package manager
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ZIXT233/ziproxy/db"
 	"github.com/ZIXT233/ziproxy/proxy"
@@ -21,7 +27,8 @@ var (
 
 func initRouter(geoDir string) {
 	var err error
-	siteDb, err = geosite.FromFile(geoDir + "/geosite.dat")
+	geositeFile = geoDir + "/geosite.dat"
+	siteDb, err = geosite.FromFile(geositeFile)
 	if err != nil {
 		log.Fatal("failed to load geosite.dat:", err)
 	}
@@ -30,64 +37,323 @@ func initRouter(geoDir string) {
 		log.Fatal("failed to load geoip.dat:", err)
 	}
 }
-func matchDomain(pattern, domain string) bool {
-	if pattern == "*" {
-		return true // 匹配任何域名
+
+// 路由规则类型
+const (
+	RuleAny           = "any"
+	RuleDomain        = "domain"         //按标签逐级匹配的域名，*匹配单个标签
+	RuleDomainSuffix  = "domain-suffix"  //域名及其子域名
+	RuleDomainKeyword = "domain-keyword" //域名包含关键字
+	RuleDomainRegex   = "domain-regex"   //域名正则表达式，整个pattern作为一个表达式，不以逗号分隔
+	RuleGeosite       = "geosite"
+	RuleGeoip         = "geoip" //目标地址所属地区，域名目标解析后查询
+	RuleIP            = "ip"
+	RuleDstPort       = "dst-port" //目标端口，支持8000-9000形式的范围
+	RuleSrcIP         = "src-ip"   //客户端来源地址
+	RuleInbound       = "inbound"  //入站代理ID
+	RuleUser          = "user"     //代理用户ID
+	RuleRuleSet       = "rule-set" //规则集ID
+)
+
+// ValidateRule 检查路由规则的类型和匹配模式，避免无效规则在匹配时被静默忽略
+func ValidateRule(r *db.Rule) error {
+	if r.Type == RuleAny {
+		return nil
+	}
+	if strings.TrimSpace(r.Pattern) == "" {
+		return fmt.Errorf("rule pattern is empty")
+	}
+	if r.Type == RuleDomainRegex {
+		_, err := regexp.Compile(r.Pattern)
+		return err
 	}
-	patternParts := strings.Split(pattern, ".")
-	domainParts := strings.Split(domain, ".")
+	for _, pattern := range strings.Split(r.Pattern, ",") {
+		if pattern == "" {
+			return fmt.Errorf("rule pattern contains empty item")
+		}
+		switch r.Type {
+		case RuleDomain, RuleDomainSuffix, RuleDomainKeyword, RuleGeosite, RuleGeoip, RuleInbound, RuleUser:
+		case RuleIP, RuleSrcIP:
+			if pattern != "*" && net.ParseIP(pattern) == nil {
+				if _, _, err := net.ParseCIDR(pattern); err != nil {
+					return fmt.Errorf("invalid ip or cidr %s", pattern)
+				}
+			}
+		case RuleDstPort:
+			if _, _, err := parsePortRange(pattern); err != nil {
+				return err
+			}
+		case RuleRuleSet:
+			if _, ok := RuleSetMap.Load(pattern); !ok {
+				return fmt.Errorf("rule set %s not found", pattern)
+			}
+		default:
+			return fmt.Errorf("unknown rule type %s", r.Type)
+		}
+	}
+	return nil
+}
 
-	if len(patternParts) != len(domainParts) {
-		return false
+// 解析端口或端口范围
+func parsePortRange(pattern string) (int, int, error) {
+	low, high, isRange := strings.Cut(pattern, "-")
+	if !isRange {
+		high = low
 	}
+	from, err1 := strconv.Atoi(strings.TrimSpace(low))
+	to, err2 := strconv.Atoi(strings.TrimSpace(high))
+	if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("invalid port range %s", pattern)
+	}
+	return from, to, nil
+}
 
-	for i := range patternParts {
-		if patternParts[i] != "*" && patternParts[i] != domainParts[i] {
-			return false
-		}
+// 从host:port形式的地址中取得IP，无法解析时返回nil
+func addrIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
 	}
+	return net.ParseIP(host)
+}
 
-	return true
+// 编译后的路由方案，规则按优先级排列，各类型的匹配项建立索引，
+// 匹配耗时只与代理目标相关，不随规则数量增长(domain-keyword、domain-regex规则除外)
+type compiledScheme struct {
+	enabled     bool
+	rules       []*compiledRule
+	always      []int //any规则及匹配任何域名的domain规则
+	domains     *domainTrie
+	keywords    []ruleItem[string]
+	regexes     []ruleItem[*regexp.Regexp]
+	geosite     map[string][]int
+	geoip       map[string][]int
+	ips         *cidrTree
+	srcIPs      *cidrTree
+	ports       []ruleItem[[2]int]
+	inbounds    map[string][]int
+	users       map[string][]int
+	resolveFrom int //首个需要在本地解析域名的ip、geoip、rule-set规则序号，没有时为-1
 }
 
-func matchGeo(pattern string, codes []string) bool {
-	for _, code := range codes {
-		if code == pattern {
-			return true
+type compiledRule struct {
+	ID        uint
+	Name      string
+	Type      string
+	Pattern   string
+	Priority  uint
+	NoResolve bool
+	Outbounds []string
+
+	needResolve bool //域名目标需要在本地解析后才能匹配
+}
+
+type ruleItem[T any] struct {
+	value T
+	rule  int
+}
+
+// 路由方案ID -> *compiledScheme，更新时整体替换，匹配过程无需加锁
+var routeTable atomic.Pointer[map[string]*compiledScheme]
+
+// 保护路由方案的编译与替换，保证按更新顺序生效
+var routeTableMu sync.Mutex
+
+// 编译路由方案，规则按优先级排序，无效的规则记录日志后忽略
+func compileRouteScheme(scheme *db.RouteScheme) *compiledScheme {
+	rules := slices.Clone(scheme.Rules)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	cs := &compiledScheme{
+		enabled:     scheme.Enabled,
+		domains:     newDomainTrie(),
+		geosite:     make(map[string][]int),
+		geoip:       make(map[string][]int),
+		ips:         newCIDRTree(),
+		srcIPs:      newCIDRTree(),
+		inbounds:    make(map[string][]int),
+		users:       make(map[string][]int),
+		resolveFrom: -1,
+	}
+	for _, r := range rules {
+		if err := ValidateRule(&r); err != nil {
+			log.Printf("Route scheme %s rule %d(%s) ignored: %v", scheme.ID, r.ID, r.Name, err)
+			continue
+		}
+		i := len(cs.rules)
+		rule := &compiledRule{ID: r.ID, Name: r.Name, Type: r.Type, Pattern: r.Pattern, Priority: r.Priority, NoResolve: r.NoResolve}
+		for _, o := range r.Outbounds {
+			rule.Outbounds = append(rule.Outbounds, o.ID)
+		}
+		cs.rules = append(cs.rules, rule)
+		rule.needResolve = (r.Type == RuleIP || r.Type == RuleGeoip) && !r.NoResolve
+		switch r.Type {
+		case RuleAny:
+			cs.always = append(cs.always, i)
+			continue
+		case RuleDomainRegex:
+			cs.regexes = append(cs.regexes, ruleItem[*regexp.Regexp]{regexp.MustCompile(r.Pattern), i})
+			continue
+		}
+		for _, pattern := range strings.Split(r.Pattern, ",") {
+			switch r.Type {
+			case RuleDomain:
+				if pattern == "*" {
+					cs.always = append(cs.always, i)
+				} else {
+					cs.domains.insertFull(pattern, i)
+				}
+			case RuleDomainSuffix:
+				cs.domains.insertSuffix(strings.TrimPrefix(pattern, "."), i)
+			case RuleDomainKeyword:
+				cs.keywords = append(cs.keywords, ruleItem[string]{strings.ToLower(pattern), i})
+			case RuleGeosite:
+				cs.geosite[pattern] = append(cs.geosite[pattern], i)
+			case RuleGeoip:
+				cs.geoip[pattern] = append(cs.geoip[pattern], i)
+			case RuleIP:
+				cs.ips.insert(pattern, i)
+			case RuleSrcIP:
+				cs.srcIPs.insert(pattern, i)
+			case RuleDstPort:
+				from, to, _ := parsePortRange(pattern)
+				cs.ports = append(cs.ports, ruleItem[[2]int]{[2]int{from, to}, i})
+			case RuleInbound:
+				cs.inbounds[pattern] = append(cs.inbounds[pattern], i)
+			case RuleUser:
+				cs.users[pattern] = append(cs.users[pattern], i)
+			case RuleRuleSet:
+				if cs.insertRuleSet(pattern, i) && !r.NoResolve {
+					rule.needResolve = true
+				}
+			}
+		}
+		if rule.needResolve && cs.resolveFrom < 0 {
+			cs.resolveFrom = i
 		}
 	}
-	return false
+	return cs
 }
 
-func matchIP(pattern string, ip net.IP) bool {
-	// 如果pattern是*，则匹配任何IP
-	if pattern == "*" {
-		return true
-	}
-	// 如果pattern是CIDR，则比较IP地址和CIDR
-	if strings.Contains(pattern, "/") {
-		_, cidr, err := net.ParseCIDR(pattern)
-		if err != nil {
-			return false
+// 更新路由方案的编译结果，scheme为nil时删除，调用时需持有routeTableMu
+func updateRouteTable(id string, scheme *compiledScheme) {
+	table := make(map[string]*compiledScheme)
+	if old := routeTable.Load(); old != nil {
+		for k, v := range *old {
+			table[k] = v
 		}
-		return cidr.Contains(ip)
 	}
-	// 如果pattern是IP地址，则直接比较
-	if strings.Contains(pattern, ".") {
-		return pattern == ip.String()
+	if scheme == nil {
+		delete(table, id)
+	} else {
+		table[id] = scheme
 	}
-	return false
+	routeTable.Store(&table)
 }
 
-func RouteOutbound(target *proxy.TargetAddr, inboundName string) string {
-	var geoCodes []string
-	//查询代理目标的地理位置或着组织信息
-	if target.Hostname != "" {
-		geoCodes = siteDb.LookupCodes(target.Hostname)
-	} else {
-		geoCodes = ipDb.LookupCode(target.IP)
+func loadCompiledScheme(id string) (*compiledScheme, bool) {
+	table := routeTable.Load()
+	if table == nil {
+		return nil, false
+	}
+	scheme, ok := (*table)[id]
+	return scheme, ok
+}
+
+// 路由匹配需要在本地解析域名目标时调用，返回是否得到了地址
+type routeResolver func(target *proxy.TargetAddr) bool
+
+// 通过配置的DNS解析器解析域名目标
+func resolveTarget(target *proxy.TargetAddr) bool {
+	if _, err := target.ResolveIP(); err != nil {
+		log.Printf("Resolve %s failed: %v", target.Hostname, err)
+	}
+	return target.IP != nil
+}
+
+// 返回匹配代理目标的规则序号，按优先级升序排列。resolve为nil时不解析域名目标，ip、geoip规则视为不匹配
+func (cs *compiledScheme) match(target *proxy.TargetAddr, inboundName string, srcIP net.IP, resolve routeResolver) []int {
+	hits := slices.Clone(cs.always)
+	host := strings.ToLower(target.Hostname)
+	if host != "" {
+		hits = cs.domains.lookup(host, hits)
+		for _, k := range cs.keywords {
+			if strings.Contains(host, k.value) {
+				hits = append(hits, k.rule)
+			}
+		}
+		for _, re := range cs.regexes {
+			if re.value.MatchString(target.Hostname) {
+				hits = append(hits, re.rule)
+			}
+		}
+	}
+	//查询代理目标的地理位置或着组织信息，目标为IP时geosite规则匹配geoip代码
+	if len(cs.geosite) > 0 {
+		var geoCodes []string
+		if host != "" {
+			geoCodes = siteDb.LookupCodes(host)
+		} else {
+			geoCodes = ipDb.LookupCode(target.IP)
+		}
+		for _, code := range geoCodes {
+			hits = append(hits, cs.geosite[code]...)
+		}
+	}
+	hits = cs.srcIPs.lookup(srcIP, hits)
+	for _, p := range cs.ports {
+		if target.Port >= p.value[0] && target.Port <= p.value[1] {
+			hits = append(hits, p.rule)
+		}
+	}
+	hits = append(hits, cs.inbounds[inboundName]...)
+	hits = append(hits, cs.users[target.UserId]...)
+
+	//域名目标只在需要解析的ip、geoip规则之前没有其他规则匹配时才解析地址，设置noResolve的规则不匹配解析得到的地址
+	resolved := false
+	if resolve != nil && cs.resolveFrom >= 0 && target.IP == nil && host != "" && !slices.ContainsFunc(hits, func(i int) bool {
+		return i <= cs.resolveFrom
+	}) {
+		resolved = resolve(target)
 	}
+	if target.IP != nil {
+		ipHits := cs.ips.lookup(target.IP, nil)
+		if len(cs.geoip) > 0 {
+			for _, code := range ipDb.LookupCode(target.IP) {
+				ipHits = append(ipHits, cs.geoip[code]...)
+			}
+		}
+		if resolved {
+			ipHits = slices.DeleteFunc(ipHits, func(i int) bool {
+				return cs.rules[i].NoResolve
+			})
+		}
+		hits = append(hits, ipHits...)
+	}
+
+	slices.Sort(hits)
+	return slices.Compact(hits)
+}
 
+// 为代理目标匹配出站代理，返回首选的出站代理ID
+func RouteOutbound(target *proxy.TargetAddr, inboundName string, srcIP net.IP) string {
+	return RouteOutbounds(target, inboundName, srcIP)[0]
+}
+
+// 为代理目标匹配出站代理，按优先级返回候选出站代理ID列表，供拨号失败时依次重试。
+// 首个匹配规则的出站代理排在最前，之间随机排列实现负载均衡，其后依次是后续匹配规则的出站代理。
+// 列表至少包含一个元素，无法访问时为block。srcIP为客户端来源地址，供src-ip规则匹配
+func RouteOutbounds(target *proxy.TargetAddr, inboundName string, srcIP net.IP) []string {
+	//透明代理连接的目标为Fake-IP时还原域名
+	restoreFakeIP(target)
+	return routeOutbounds(target, inboundName, srcIP, resolveTarget)
+}
+
+// 按路由方案匹配候选出站代理，resolve为nil时不解析域名目标
+func routeOutbounds(target *proxy.TargetAddr, inboundName string, srcIP net.IP, resolve routeResolver) []string {
+
+	var candidates []string
 	if user, ok := UserMap.Load(target.UserId); ok {
 		//根据代理用户查询对应代理用户组
 		if userGroup, ok := UserGroupMap.Load(user.(*db.User).UserGroupID); ok {
@@ -99,47 +365,27 @@ func RouteOutbound(target *proxy.TargetAddr, inboundName string) string {
 				}
 			}
 			if !avail_inbound {
-				return "block"
+				return []string{"block"}
 			}
-			//根据代理用户组查询对应路由发难
-			if routeScheme, ok := RouteSchemeMap.Load(userGroup.(*db.UserGroup).RouteSchemeID); ok {
-				if !routeScheme.(*db.RouteScheme).Enabled {
-					return "block"
+			//根据代理用户组查询对应路由方案的编译结果
+			if scheme, ok := loadCompiledScheme(userGroup.(*db.UserGroup).RouteSchemeID); ok {
+				if !scheme.enabled {
+					return []string{"block"}
 				}
-				//关联路由规则已经由GORM框架的Preload机制自动装载
-				rules := routeScheme.(*db.RouteScheme).Rules
-				sort.Slice(rules, func(i, j int) bool {
-					return rules[i].Priority < rules[j].Priority
-				})
-				//迭代匹配路由规则
-				for _, r := range rules {
-					var match bool
-					patterns := strings.Split(r.Pattern, ",")
-					for _, pattern := range patterns {
-						switch r.Type {
-						case "geosite":
-							match = matchGeo(pattern, geoCodes)
-						case "domain":
-							match = matchDomain(pattern, target.Hostname)
-						case "ip":
-							match = matchIP(pattern, target.IP)
-						case "any":
-							match = true
-						default:
-							match = false
-						}
-						if match {
-							break
+				for _, i := range scheme.match(target, inboundName, srcIP, resolve) {
+					//在多个出站代理之间进行随机负载均衡
+					outbounds := scheme.rules[i].Outbounds
+					for _, j := range rand.Perm(len(outbounds)) {
+						if id := outbounds[j]; !slices.Contains(candidates, id) {
+							candidates = append(candidates, id)
 						}
 					}
-					if match {
-						//出站代理ID列表已经由GORM框架的Preload机制装载，在多个入站代理之间进行随机负载均衡
-						id := r.Outbounds[rand.Intn(len(r.Outbounds))].ID
-						return id
-					}
 				}
 			}
 		}
 	}
-	return "block"
+	if len(candidates) == 0 {
+		return []string{"block"}
+	}
+	return candidates
 }
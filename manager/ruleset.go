@@ -0,0 +1,342 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// 规则集格式
+const (
+	RuleSetList    = "list"     //纯文本列表，每行一个域名或CIDR
+	RuleSetClash   = "clash"    //Clash rule-provider YAML
+	RuleSetSingBox = "sing-box" //sing-box二进制规则集(.srs)或源格式JSON
+)
+
+const (
+	defaultRuleSetInterval = 24 * time.Hour
+	ruleSetFetchTimeout    = time.Minute
+	ruleSetRetryInterval   = 5 * time.Minute
+	maxRuleSetSize         = 64 << 20
+)
+
+var (
+	RuleSetDir = "ruleset" //远程规则集的本地缓存目录，可在config.json中通过rule_set_dir配置
+	RuleSetMap sync.Map    //规则集ID -> *ruleSet
+)
+
+// 规则集中的匹配项
+type ruleSetData struct {
+	Full      []string //完整域名，*匹配单个标签
+	Suffix    []string //域名及其子域名
+	Subdomain []string //仅子域名
+	Keyword   []string
+	Regex     []string
+	CIDR      []string
+}
+
+func (d *ruleSetData) count() int {
+	return len(d.Full) + len(d.Suffix) + len(d.Subdomain) + len(d.Keyword) + len(d.Regex) + len(d.CIDR)
+}
+
+// RuleSetStatus 规则集的加载状态
+type RuleSetStatus struct {
+	Entries   int       `json:"entries"`
+	UpdatedAt time.Time `json:"updatedAt"` //内容最近一次更新的时间，远程规则集为缓存文件的更新时间
+	Error     string    `json:"error,omitempty"`
+}
+
+type ruleSet struct {
+	config db.RuleSet
+	stop   chan struct{}
+
+	mu      sync.Mutex
+	data    *ruleSetData
+	updated time.Time
+	lastErr error
+}
+
+func isRemoteRuleSet(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// ValidateRuleSet 检查规则集的格式与来源
+func ValidateRuleSet(d *db.RuleSet) error {
+	switch d.Format {
+	case RuleSetList, RuleSetClash, RuleSetSingBox:
+	default:
+		return fmt.Errorf("unknown rule set format %s", d.Format)
+	}
+	if d.Source == "" {
+		return errors.New("rule set source is empty")
+	}
+	if isRemoteRuleSet(d.Source) {
+		if _, err := url.Parse(d.Source); err != nil {
+			return err
+		}
+	} else if d.OutboundID != "" {
+		return errors.New("outbound is only used by remote rule sets")
+	}
+	return nil
+}
+
+func (s *ruleSet) interval() time.Duration {
+	if s.config.Interval == 0 {
+		return defaultRuleSetInterval
+	}
+	return time.Duration(s.config.Interval) * time.Second
+}
+
+func (s *ruleSet) cachePath() string {
+	return filepath.Join(RuleSetDir, url.PathEscape(s.config.ID)+".cache")
+}
+
+func (s *ruleSet) load() *ruleSetData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data
+}
+
+func (s *ruleSet) status() RuleSetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var status RuleSetStatus
+	if s.data != nil {
+		status.Entries = s.data.count()
+	}
+	status.UpdatedAt = s.updated
+	if s.lastErr != nil {
+		status.Error = s.lastErr.Error()
+	}
+	return status
+}
+
+func (s *ruleSet) setResult(data *ruleSetData, updated time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.data, s.updated = data, updated
+	}
+	s.lastErr = err
+}
+
+// 下载远程规则集，配置了出站代理时经由出站代理下载
+func (s *ruleSet) download() ([]byte, error) {
+	client := &http.Client{Timeout: ruleSetFetchTimeout}
+	if s.config.OutboundID != "" {
+		u, err := url.Parse(s.config.Source)
+		if err != nil {
+			return nil, err
+		}
+		outbound, ok := resolveOutbound(s.config.OutboundID, &proxy.TargetAddr{Hostname: u.Hostname()})
+		if !ok {
+			return nil, ErrOutboundNotFound
+		}
+		client.Transport = &http.Transport{
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialThrough(outbound, addr)
+			},
+		}
+	}
+	resp, err := client.Get(s.config.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRuleSetSize))
+}
+
+// 重新获取规则集内容，远程规则集成功后写入缓存文件，内容更新后重新编译路由方案
+func (s *ruleSet) refresh() error {
+	var content []byte
+	var err error
+	if isRemoteRuleSet(s.config.Source) {
+		content, err = s.download()
+	} else {
+		content, err = os.ReadFile(s.config.Source)
+	}
+	var data *ruleSetData
+	if err == nil {
+		data, err = parseRuleSet(s.config.Format, content)
+	}
+	s.setResult(data, time.Now(), err)
+	if err != nil {
+		return err
+	}
+	if isRemoteRuleSet(s.config.Source) {
+		if err := os.MkdirAll(RuleSetDir, 0755); err != nil {
+			log.Printf("Failed to create rule set cache dir err: %v", err)
+		} else if err := os.WriteFile(s.cachePath(), content, 0644); err != nil {
+			log.Printf("Failed to write rule set %s cache err: %v", s.config.ID, err)
+		}
+	}
+	log.Printf("Rule set %s updated with %d entries", s.config.ID, data.count())
+	recompileRouteSchemes()
+	return nil
+}
+
+// 从缓存文件加载远程规则集，返回缓存是否仍在更新间隔内
+func (s *ruleSet) loadCache() bool {
+	info, err := os.Stat(s.cachePath())
+	if err != nil {
+		return false
+	}
+	content, err := os.ReadFile(s.cachePath())
+	if err != nil {
+		return false
+	}
+	data, err := parseRuleSet(s.config.Format, content)
+	if err != nil {
+		log.Printf("Failed to parse rule set %s cache err: %v", s.config.ID, err)
+		return false
+	}
+	s.setResult(data, info.ModTime(), nil)
+	return time.Since(info.ModTime()) < s.interval()
+}
+
+// 启动规则集的后台更新协程，本地文件立即加载，远程规则集优先使用缓存，缓存过期或不存在时在后台下载
+func (s *ruleSet) start() {
+	fresh := false
+	if isRemoteRuleSet(s.config.Source) {
+		fresh = s.loadCache()
+	} else {
+		if err := s.refresh(); err != nil {
+			log.Printf("Failed to load rule set %s err: %v", s.config.ID, err)
+		}
+		fresh = true
+	}
+	go func() {
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			next := s.interval()
+			if !fresh {
+				if err := s.refresh(); err != nil {
+					log.Printf("Failed to update rule set %s err: %v", s.config.ID, err)
+					//启动时出站代理可能尚未加载，失败后较快重试
+					next = min(next, ruleSetRetryInterval)
+				}
+			}
+			fresh = false
+			timer.Reset(next)
+			select {
+			case <-timer.C:
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func SyncRuleSet(d *db.RuleSet) {
+	if val, ok := RuleSetMap.Load(d.ID); ok {
+		close(val.(*ruleSet).stop)
+	}
+	s := &ruleSet{config: *d, stop: make(chan struct{})}
+	RuleSetMap.Store(d.ID, s)
+	s.start()
+	recompileRouteSchemes()
+}
+
+func RemoveRuleSet(id string) {
+	if val, ok := RuleSetMap.LoadAndDelete(id); ok {
+		close(val.(*ruleSet).stop)
+		os.Remove(val.(*ruleSet).cachePath())
+	}
+	recompileRouteSchemes()
+}
+
+// RefreshRuleSet 立即更新规则集
+func RefreshRuleSet(id string) error {
+	val, ok := RuleSetMap.Load(id)
+	if !ok {
+		return errors.New("rule set not found")
+	}
+	return val.(*ruleSet).refresh()
+}
+
+// GetRuleSetStatus 获取规则集的加载状态
+func GetRuleSetStatus(id string) (RuleSetStatus, bool) {
+	val, ok := RuleSetMap.Load(id)
+	if !ok {
+		return RuleSetStatus{}, false
+	}
+	return val.(*ruleSet).status(), true
+}
+
+// RuleSetInUse 判断规则集是否被路由规则引用
+func RuleSetInUse(id string) bool {
+	inUse := false
+	RouteSchemeMap.Range(func(key, value any) bool {
+		for _, r := range value.(*db.RouteScheme).Rules {
+			if r.Type == RuleRuleSet && slices.Contains(strings.Split(r.Pattern, ","), id) {
+				inUse = true
+			}
+		}
+		return !inUse
+	})
+	return inUse
+}
+
+// 规则集内容变化后重新编译所有路由方案
+func recompileRouteSchemes() {
+	routeTableMu.Lock()
+	defer routeTableMu.Unlock()
+	RouteSchemeMap.Range(func(key, value any) bool {
+		scheme := value.(*db.RouteScheme)
+		updateRouteTable(scheme.ID, compileRouteScheme(scheme))
+		return true
+	})
+}
+
+// 编译时将规则集的匹配项加入路由方案索引，返回规则集是否包含需要解析域名的CIDR
+func (cs *compiledScheme) insertRuleSet(id string, rule int) bool {
+	val, ok := RuleSetMap.Load(id)
+	if !ok {
+		return false
+	}
+	data := val.(*ruleSet).load()
+	if data == nil {
+		return false
+	}
+	for _, domain := range data.Full {
+		cs.domains.insertFull(domain, rule)
+	}
+	for _, domain := range data.Suffix {
+		cs.domains.insertSuffix(domain, rule)
+	}
+	for _, domain := range data.Subdomain {
+		cs.domains.insertSubdomain(domain, rule)
+	}
+	for _, keyword := range data.Keyword {
+		cs.keywords = append(cs.keywords, ruleItem[string]{strings.ToLower(keyword), rule})
+	}
+	for _, pattern := range data.Regex {
+		if re, err := regexp.Compile(pattern); err == nil {
+			cs.regexes = append(cs.regexes, ruleItem[*regexp.Regexp]{re, rule})
+		}
+	}
+	for _, cidr := range data.CIDR {
+		cs.ips.insert(cidr, rule)
+	}
+	return len(data.CIDR) > 0
+}
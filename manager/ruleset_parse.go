@@ -0,0 +1,571 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 按格式解析规则集内容
+func parseRuleSet(format string, content []byte) (*ruleSetData, error) {
+	data := &ruleSetData{}
+	var err error
+	switch format {
+	case RuleSetList:
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "//") {
+				continue
+			}
+			data.addEntry(line, true)
+		}
+	case RuleSetClash:
+		err = data.parseClash(content)
+	case RuleSetSingBox:
+		if bytes.HasPrefix(content, srsMagic) {
+			err = data.parseSRS(content)
+		} else {
+			err = data.parseSingBoxSource(content)
+		}
+	default:
+		err = fmt.Errorf("unknown rule set format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	//Go的正则表达式不支持部分语法，无法编译的表达式忽略
+	valid := data.Regex[:0]
+	for _, pattern := range data.Regex {
+		if _, err := regexp.Compile(pattern); err == nil {
+			valid = append(valid, pattern)
+		} else {
+			log.Printf("Rule set regex %s ignored: %v", pattern, err)
+		}
+	}
+	data.Regex = valid
+	return data, nil
+}
+
+// 添加一个匹配项。支持full:、domain:、keyword:、regexp:前缀，IP或CIDR，
+// +.开头匹配域名及其子域名，.开头仅匹配子域名，含*标签时按标签匹配。
+// 其余域名在纯文本列表中匹配域名及其子域名，在Clash domain规则集中为完整域名
+func (d *ruleSetData) addEntry(entry string, plainAsSuffix bool) {
+	entry = strings.Trim(strings.TrimSpace(entry), `'"`)
+	if prefix, value, ok := strings.Cut(entry, ":"); ok && net.ParseIP(entry) == nil {
+		switch prefix {
+		case "full":
+			d.Full = append(d.Full, value)
+			return
+		case "domain":
+			d.Suffix = append(d.Suffix, value)
+			return
+		case "keyword":
+			d.Keyword = append(d.Keyword, value)
+			return
+		case "regexp":
+			d.Regex = append(d.Regex, value)
+			return
+		}
+	}
+	switch {
+	case entry == "":
+	case net.ParseIP(entry) != nil:
+		d.CIDR = append(d.CIDR, entry)
+	case strings.Contains(entry, "/"):
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			d.CIDR = append(d.CIDR, entry)
+		}
+	case strings.HasPrefix(entry, "+."):
+		d.Suffix = append(d.Suffix, entry[2:])
+	case strings.HasPrefix(entry, "."):
+		d.Subdomain = append(d.Subdomain, entry[1:])
+	case strings.Contains(entry, "*") || !plainAsSuffix:
+		d.Full = append(d.Full, entry)
+	default:
+		d.Suffix = append(d.Suffix, entry)
+	}
+}
+
+// Clash rule-provider，payload中为domain、ipcidr规则或TYPE,VALUE形式的classical规则，classical规则只支持域名与IP类型
+func (d *ruleSetData) parseClash(content []byte) error {
+	var provider struct {
+		Payload []string `yaml:"payload"`
+	}
+	if err := yaml.Unmarshal(content, &provider); err != nil {
+		return err
+	}
+	for _, entry := range provider.Payload {
+		kind, value, classical := strings.Cut(entry, ",")
+		if !classical {
+			d.addEntry(entry, false)
+			continue
+		}
+		value, _, _ = strings.Cut(value, ",") //忽略no-resolve等参数
+		switch strings.ToUpper(strings.TrimSpace(kind)) {
+		case "DOMAIN":
+			d.Full = append(d.Full, value)
+		case "DOMAIN-SUFFIX":
+			d.Suffix = append(d.Suffix, value)
+		case "DOMAIN-KEYWORD":
+			d.Keyword = append(d.Keyword, value)
+		case "DOMAIN-REGEX":
+			d.Regex = append(d.Regex, value)
+		case "IP-CIDR", "IP-CIDR6":
+			d.CIDR = append(d.CIDR, value)
+		}
+	}
+	return nil
+}
+
+// sing-box规则集源格式，只使用domain、domain_suffix、domain_keyword、domain_regex、ip_cidr，
+// 含有其他条件、取反或逻辑规则的规则无法等价表示，予以忽略
+func (d *ruleSetData) parseSingBoxSource(content []byte) error {
+	var source struct {
+		Rules []map[string]json.RawMessage `json:"rules"`
+	}
+	if err := json.Unmarshal(content, &source); err != nil {
+		return err
+	}
+	skipped := 0
+	for _, rule := range source.Rules {
+		var r ruleSetData
+		supported := true
+		for key, raw := range rule {
+			var values []string
+			if err := json.Unmarshal(raw, &values); err != nil {
+				var value string
+				if err := json.Unmarshal(raw, &value); err != nil {
+					supported = false
+					break
+				}
+				values = []string{value}
+			}
+			switch key {
+			case "domain":
+				r.Full = append(r.Full, values...)
+			case "domain_suffix":
+				for _, v := range values {
+					if strings.HasPrefix(v, ".") {
+						r.Subdomain = append(r.Subdomain, v[1:])
+					} else {
+						r.Suffix = append(r.Suffix, v)
+					}
+				}
+			case "domain_keyword":
+				r.Keyword = append(r.Keyword, values...)
+			case "domain_regex":
+				r.Regex = append(r.Regex, values...)
+			case "ip_cidr":
+				r.CIDR = append(r.CIDR, values...)
+			default:
+				supported = false
+			}
+		}
+		if supported {
+			d.merge(&r)
+		} else {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Rule set ignored %d unsupported sing-box rules", skipped)
+	}
+	return nil
+}
+
+func (d *ruleSetData) merge(r *ruleSetData) {
+	d.Full = append(d.Full, r.Full...)
+	d.Suffix = append(d.Suffix, r.Suffix...)
+	d.Subdomain = append(d.Subdomain, r.Subdomain...)
+	d.Keyword = append(d.Keyword, r.Keyword...)
+	d.Regex = append(d.Regex, r.Regex...)
+	d.CIDR = append(d.CIDR, r.CIDR...)
+}
+
+var srsMagic = []byte("SRS")
+
+// sing-box二进制规则集的规则项类型
+const (
+	srsItemQueryType uint8 = iota
+	srsItemNetwork
+	srsItemDomain
+	srsItemDomainKeyword
+	srsItemDomainRegex
+	srsItemSourceIPCIDR
+	srsItemIPCIDR
+	srsItemSourcePort
+	srsItemSourcePortRange
+	srsItemPort
+	srsItemPortRange
+	srsItemProcessName
+	srsItemProcessPath
+	srsItemPackageName
+	srsItemWIFISSID
+	srsItemWIFIBSSID
+	srsItemAdGuardDomain
+	srsItemProcessPathRegex
+	srsItemFinal uint8 = 0xFF
+)
+
+// 域名集合中标记后缀匹配的标签
+const (
+	srsPrefixLabel = '\r' //仅子域名
+	srsRootLabel   = '\n' //域名及其子域名
+)
+
+// sing-box二进制规则集解压后的大小上限，规则集内容不可信，超过上限视为无效
+const maxSRSSize = 32 << 20
+
+// 逻辑规则嵌套的最大层数
+const maxSRSDepth = 16
+
+var errSRSInvalid = errors.New("invalid sing-box rule set")
+
+// 解压后的规则集读取器，读取的数据量不超过maxSRSSize，列表长度不能超过剩余数据
+type srsReader struct {
+	*bufio.Reader
+	limit *io.LimitedReader
+	out   int //已还原的域名总长度
+}
+
+// 剩余可读取的字节数
+func (r *srsReader) remaining() uint64 {
+	return uint64(r.limit.N) + uint64(r.Buffered())
+}
+
+// 读取列表长度，每个元素至少占用size字节，超过剩余数据时返回错误而不分配内存
+func (r *srsReader) readCount(size uint64) (uint64, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if count > r.remaining()/size {
+		return 0, errSRSInvalid
+	}
+	return count, nil
+}
+
+// 读取带长度前缀的字节串
+func (r *srsReader) readBytes() ([]byte, error) {
+	length, err := r.readCount(1)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// sing-box二进制规则集：SRS魔数、版本号，之后为zlib压缩的规则列表
+func (d *ruleSetData) parseSRS(content []byte) error {
+	if len(content) < 4 || content[3] < 1 || content[3] > 3 {
+		return errors.New("unsupported sing-box rule set version")
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(content[4:]))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	limit := &io.LimitedReader{R: zr, N: maxSRSSize}
+	r := &srsReader{Reader: bufio.NewReader(limit), limit: limit}
+	err = d.readSRSRules(r)
+	if err != nil && limit.N == 0 {
+		return fmt.Errorf("sing-box rule set exceeds %d bytes after decompression", maxSRSSize)
+	}
+	return err
+}
+
+func (d *ruleSetData) readSRSRules(r *srsReader) error {
+	//每条规则至少包含类型、结束标记和取反标记
+	count, err := r.readCount(3)
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	for i := uint64(0); i < count; i++ {
+		rule, supported, err := readSRSRule(r, 0)
+		if err != nil {
+			return err
+		}
+		if supported {
+			d.merge(rule)
+		} else {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Rule set ignored %d unsupported sing-box rules", skipped)
+	}
+	return nil
+}
+
+// 读取一条规则，与parseSingBoxSource相同，只有不含其他条件的普通规则可以使用
+func readSRSRule(r *srsReader, depth int) (*ruleSetData, bool, error) {
+	ruleType, err := r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+	switch ruleType {
+	case 0:
+	case 1:
+		//逻辑规则：模式、子规则列表、取反标记
+		if depth >= maxSRSDepth {
+			return nil, false, errSRSInvalid
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return nil, false, err
+		}
+		count, err := r.readCount(3)
+		if err != nil {
+			return nil, false, err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, _, err := readSRSRule(r, depth+1); err != nil {
+				return nil, false, err
+			}
+		}
+		_, err = r.ReadByte()
+		return nil, false, err
+	default:
+		return nil, false, fmt.Errorf("unknown sing-box rule type %d", ruleType)
+	}
+	rule := &ruleSetData{}
+	supported := true
+	for {
+		itemType, err := r.ReadByte()
+		if err != nil {
+			return nil, false, err
+		}
+		var values []string
+		switch itemType {
+		case srsItemDomain:
+			err = readSRSDomain(r, rule)
+		case srsItemDomainKeyword:
+			values, err = readSRSStrings(r)
+			rule.Keyword = append(rule.Keyword, values...)
+		case srsItemDomainRegex:
+			values, err = readSRSStrings(r)
+			rule.Regex = append(rule.Regex, values...)
+		case srsItemIPCIDR:
+			values, err = readSRSIPSet(r)
+			rule.CIDR = append(rule.CIDR, values...)
+		case srsItemSourceIPCIDR:
+			_, err = readSRSIPSet(r)
+			supported = false
+		case srsItemQueryType, srsItemSourcePort, srsItemPort:
+			_, err = readSRSStrings(r, 2)
+			supported = false
+		case srsItemNetwork, srsItemSourcePortRange, srsItemPortRange, srsItemProcessName, srsItemProcessPath,
+			srsItemPackageName, srsItemWIFISSID, srsItemWIFIBSSID, srsItemProcessPathRegex:
+			_, err = readSRSStrings(r)
+			supported = false
+		case srsItemFinal:
+			invert, err := r.ReadByte()
+			if err != nil {
+				return nil, false, err
+			}
+			return rule, supported && invert == 0, nil
+		default:
+			return nil, false, fmt.Errorf("unsupported sing-box rule item %d", itemType)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// 读取字符串列表，width不为0时为定长整数列表，只跳过不解析
+func readSRSStrings(r *srsReader, width ...int) ([]string, error) {
+	if len(width) > 0 {
+		count, err := r.readCount(uint64(width[0]))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(io.Discard, r, int64(count)*int64(width[0]))
+		return nil, err
+	}
+	count, err := r.readCount(1)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for i := uint64(0); i < count; i++ {
+		value, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(value))
+	}
+	return values, nil
+}
+
+func readSRSUint64s(r *srsReader) ([]uint64, error) {
+	count, err := r.readCount(8)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]uint64, count)
+	return values, binary.Read(r, binary.BigEndian, values)
+}
+
+// 域名集合以succinct trie存储反转后的域名，按层遍历还原出所有域名。
+// 节点只记录父节点和标签，叶子节点的域名长度和还原的域名总长度都有上限
+func readSRSDomain(r *srsReader, rule *ruleSetData) error {
+	if _, err := r.ReadByte(); err != nil {
+		return err
+	}
+	leaves, err := readSRSUint64s(r)
+	if err != nil {
+		return err
+	}
+	bitmap, err := readSRSUint64s(r)
+	if err != nil {
+		return err
+	}
+	labels, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	bit := func(bm []uint64, i int) bool {
+		return i>>6 < len(bm) && bm[i>>6]&(1<<(i&63)) != 0
+	}
+	//节点按层序编号，第k个标签对应第k+1个节点，位图中每个节点的子节点标签以1结束
+	type trieNode struct {
+		parent int
+		depth  int
+	}
+	nodes := []trieNode{{parent: -1}}
+	node := 0
+	for i := 0; i < len(bitmap)*64 && node < len(nodes); i++ {
+		if bit(bitmap, i) {
+			node++
+			continue
+		}
+		if len(nodes)-1 >= len(labels) || nodes[node].depth >= 256 {
+			return errSRSInvalid
+		}
+		nodes = append(nodes, trieNode{parent: node, depth: nodes[node].depth + 1})
+	}
+	for i := 1; i < len(nodes); i++ {
+		if !bit(leaves, i) {
+			continue
+		}
+		r.out += nodes[i].depth
+		if r.out > maxSRSSize {
+			return errSRSInvalid
+		}
+		key := make([]byte, nodes[i].depth)
+		for n := i; n > 0; n = nodes[n].parent {
+			key[nodes[n].depth-1] = labels[n-1]
+		}
+		switch key[len(key)-1] {
+		case srsPrefixLabel:
+			rule.Subdomain = append(rule.Subdomain, strings.TrimPrefix(reverseRunes(key[:len(key)-1]), "."))
+		case srsRootLabel:
+			rule.Suffix = append(rule.Suffix, reverseRunes(key[:len(key)-1]))
+		default:
+			rule.Full = append(rule.Full, reverseRunes(key))
+		}
+	}
+	return nil
+}
+
+func reverseRunes(b []byte) string {
+	runes := []rune(string(b))
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// IP集合以地址范围存储，转换为CIDR列表
+func readSRSIPSet(r *srsReader) ([]string, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("unsupported sing-box ip set version %d", version)
+	}
+	var count uint64
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	//每个地址范围至少包含两个IPv4地址及其长度
+	if count > r.remaining()/10 {
+		return nil, errSRSInvalid
+	}
+	var cidrs []string
+	for i := uint64(0); i < count; i++ {
+		var addrs [2]netip.Addr
+		for j := range addrs {
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if length != net.IPv4len && length != net.IPv6len {
+				return nil, errSRSInvalid
+			}
+			b := make([]byte, length)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			addr, ok := netip.AddrFromSlice(b)
+			if !ok {
+				return nil, errors.New("invalid sing-box ip set")
+			}
+			addrs[j] = addr
+		}
+		if addrs[0].Is4() != addrs[1].Is4() {
+			return nil, errSRSInvalid
+		}
+		cidrs = append(cidrs, rangeToCIDRs(addrs[0], addrs[1])...)
+	}
+	return cidrs, nil
+}
+
+// 将地址范围拆分为最少的CIDR
+func rangeToCIDRs(from, to netip.Addr) []string {
+	var cidrs []string
+	for from.IsValid() && from.Compare(to) <= 0 {
+		bits := from.BitLen()
+		for bits > 0 {
+			p := netip.PrefixFrom(from, bits-1).Masked()
+			if p.Addr() != from || lastAddr(p).Compare(to) > 0 {
+				break
+			}
+			bits--
+		}
+		p := netip.PrefixFrom(from, bits)
+		cidrs = append(cidrs, p.String())
+		from = lastAddr(p).Next()
+	}
+	return cidrs
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Addr().As16()
+	start := p.Bits()
+	if p.Addr().Is4() {
+		start += 96
+	}
+	for i := start; i < 128; i++ {
+		a[i/8] |= 1 << (7 - i%8)
+	}
+	if p.Addr().Is4() {
+		return netip.AddrFrom4([4]byte(a[12:]))
+	}
+	return netip.AddrFrom16(a)
+}
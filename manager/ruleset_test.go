@@ -0,0 +1,454 @@
+package manager
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ZIXT233/ziproxy/db"
+)
+
+func TestParseRuleSetList(t *testing.T) {
+	content := `# comment
+! adblock comment
+// comment
+example.com
++.google.com
+.github.com
+full:exact.org
+domain:suffix.org
+keyword:ads
+regexp:^ad[0-9]+\.
+regexp:(?!lookahead)
+*.cdn.net
+10.0.0.0/8
+192.168.1.1
+2001:db8::/32
+bad/cidr
+`
+	data, err := parseRuleSet(RuleSetList, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ruleSetData{
+		Full:      []string{"exact.org", "*.cdn.net"},
+		Suffix:    []string{"example.com", "google.com", "suffix.org"},
+		Subdomain: []string{"github.com"},
+		Keyword:   []string{"ads"},
+		Regex:     []string{`^ad[0-9]+\.`},
+		CIDR:      []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"},
+	}
+	assertRuleSetData(t, data, want)
+}
+
+func TestParseRuleSetClash(t *testing.T) {
+	domain := `payload:
+  - 'example.com'
+  - '+.google.com'
+  - '.github.com'
+`
+	data, err := parseRuleSet(RuleSetClash, []byte(domain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRuleSetData(t, data, &ruleSetData{Full: []string{"example.com"}, Suffix: []string{"google.com"}, Subdomain: []string{"github.com"}})
+
+	classical := `payload:
+  - DOMAIN,exact.org
+  - DOMAIN-SUFFIX,suffix.org
+  - DOMAIN-KEYWORD,ads
+  - DOMAIN-REGEX,^ad\.
+  - IP-CIDR,10.0.0.0/8,no-resolve
+  - IP-CIDR6,2001:db8::/32
+  - PROCESS-NAME,curl
+`
+	data, err = parseRuleSet(RuleSetClash, []byte(classical))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRuleSetData(t, data, &ruleSetData{
+		Full:    []string{"exact.org"},
+		Suffix:  []string{"suffix.org"},
+		Keyword: []string{"ads"},
+		Regex:   []string{`^ad\.`},
+		CIDR:    []string{"10.0.0.0/8", "2001:db8::/32"},
+	})
+
+	if _, err := parseRuleSet(RuleSetClash, []byte("payload: [")); err == nil {
+		t.Error("expected error for invalid yaml")
+	}
+}
+
+func TestParseRuleSetSingBoxSource(t *testing.T) {
+	source := `{
+  "version": 1,
+  "rules": [
+    {"domain": ["exact.org"], "domain_suffix": ["suffix.org", ".sub.org"]},
+    {"domain_keyword": "ads", "domain_regex": ["^ad\\."]},
+    {"ip_cidr": ["10.0.0.0/8"]},
+    {"domain": ["skipped.org"], "port": [443]},
+    {"type": "logical", "mode": "and", "rules": []}
+  ]
+}`
+	data, err := parseRuleSet(RuleSetSingBox, []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRuleSetData(t, data, &ruleSetData{
+		Full:      []string{"exact.org"},
+		Suffix:    []string{"suffix.org"},
+		Subdomain: []string{"sub.org"},
+		Keyword:   []string{"ads"},
+		Regex:     []string{`^ad\.`},
+		CIDR:      []string{"10.0.0.0/8"},
+	})
+}
+
+// 生成sing-box二进制规则集，与sing-box的编码方式相同
+type srsWriter struct {
+	bytes.Buffer
+}
+
+func (w *srsWriter) uvarint(v uint64) {
+	w.Write(binary.AppendUvarint(nil, v))
+}
+
+func (w *srsWriter) strings(values ...string) {
+	w.uvarint(uint64(len(values)))
+	for _, v := range values {
+		w.uvarint(uint64(len(v)))
+		w.WriteString(v)
+	}
+}
+
+func (w *srsWriter) uint64s(values []uint64) {
+	w.uvarint(uint64(len(values)))
+	binary.Write(w, binary.BigEndian, values)
+}
+
+// 以succinct trie编码域名集合，键为反转后的域名，后缀匹配时附加标记标签
+func (w *srsWriter) domains(full, suffix, subdomain []string) {
+	type trie struct {
+		children map[byte]*trie
+		leaf     bool
+	}
+	root := &trie{children: map[byte]*trie{}}
+	insert := func(key string) {
+		n := root
+		for i := 0; i < len(key); i++ {
+			child, ok := n.children[key[i]]
+			if !ok {
+				child = &trie{children: map[byte]*trie{}}
+				n.children[key[i]] = child
+			}
+			n = child
+		}
+		n.leaf = true
+	}
+	for _, d := range full {
+		insert(reverseRunes([]byte(d)))
+	}
+	for _, d := range suffix {
+		insert(reverseRunes([]byte(d)) + string(rune(srsRootLabel)))
+	}
+	for _, d := range subdomain {
+		insert(reverseRunes([]byte("."+d)) + string(rune(srsPrefixLabel)))
+	}
+	var leaves, bitmap []uint64
+	set := func(bm *[]uint64, i int) {
+		for len(*bm) <= i>>6 {
+			*bm = append(*bm, 0)
+		}
+		(*bm)[i>>6] |= 1 << (i & 63)
+	}
+	var labels []byte
+	queue := []*trie{root}
+	bit := 0
+	for node := 0; node < len(queue); node++ {
+		n := queue[node]
+		if n.leaf {
+			set(&leaves, node)
+		}
+		keys := make([]byte, 0, len(n.children))
+		for k := range n.children {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			labels = append(labels, k)
+			queue = append(queue, n.children[k])
+			bit++
+		}
+		set(&bitmap, bit)
+		bit++
+	}
+	w.WriteByte(srsItemDomain)
+	w.WriteByte(1)
+	w.uint64s(leaves)
+	w.uint64s(bitmap)
+	w.uvarint(uint64(len(labels)))
+	w.Write(labels)
+}
+
+func (w *srsWriter) ipRanges(ranges ...[2]string) {
+	w.WriteByte(srsItemIPCIDR)
+	w.WriteByte(1)
+	binary.Write(w, binary.BigEndian, uint64(len(ranges)))
+	for _, r := range ranges {
+		for _, a := range r {
+			b := netip.MustParseAddr(a).AsSlice()
+			w.uvarint(uint64(len(b)))
+			w.Write(b)
+		}
+	}
+}
+
+func (w *srsWriter) endRule() {
+	w.WriteByte(srsItemFinal)
+	w.WriteByte(0)
+}
+
+func srsFile(t *testing.T, rules []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(srsMagic)
+	buf.WriteByte(1)
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(rules); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestParseRuleSetSRS(t *testing.T) {
+	var w srsWriter
+	w.uvarint(4)
+	//域名规则
+	w.WriteByte(0)
+	w.domains([]string{"exact.org", "例子.cn"}, []string{"google.com"}, []string{"github.com"})
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings("ads")
+	w.WriteByte(srsItemDomainRegex)
+	w.strings(`^ad\.`)
+	w.endRule()
+	//IP规则
+	w.WriteByte(0)
+	w.ipRanges([2]string{"10.0.0.0", "10.255.255.255"}, [2]string{"192.168.1.1", "192.168.1.2"})
+	w.endRule()
+	//带端口条件的规则无法等价表示
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings("skipped")
+	w.WriteByte(srsItemPort)
+	w.uvarint(1)
+	binary.Write(&w, binary.BigEndian, uint16(443))
+	w.endRule()
+	//逻辑规则
+	w.WriteByte(1)
+	w.WriteByte(0)
+	w.uvarint(1)
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomainKeyword)
+	w.strings("logical")
+	w.endRule()
+	w.WriteByte(0)
+
+	data, err := parseRuleSet(RuleSetSingBox, srsFile(t, w.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRuleSetData(t, data, &ruleSetData{
+		Full:      []string{"exact.org", "例子.cn"},
+		Suffix:    []string{"google.com"},
+		Subdomain: []string{"github.com"},
+		Keyword:   []string{"ads"},
+		Regex:     []string{`^ad\.`},
+		CIDR:      []string{"10.0.0.0/8", "192.168.1.1/32", "192.168.1.2/32"},
+	})
+}
+
+func TestParseRuleSetSRSInvalid(t *testing.T) {
+	tests := map[string]func(w *srsWriter){
+		"huge rule count": func(w *srsWriter) {
+			w.uvarint(1 << 60)
+		},
+		"huge string count": func(w *srsWriter) {
+			w.uvarint(1)
+			w.WriteByte(0)
+			w.WriteByte(srsItemDomainKeyword)
+			w.uvarint(1 << 40)
+		},
+		"huge string length": func(w *srsWriter) {
+			w.uvarint(1)
+			w.WriteByte(0)
+			w.WriteByte(srsItemDomainKeyword)
+			w.uvarint(1)
+			w.uvarint(1 << 40)
+		},
+		"huge bitmap": func(w *srsWriter) {
+			w.uvarint(1)
+			w.WriteByte(0)
+			w.WriteByte(srsItemDomain)
+			w.WriteByte(1)
+			w.uvarint(0)
+			w.uvarint(1 << 50)
+		},
+		"huge ip range count": func(w *srsWriter) {
+			w.uvarint(1)
+			w.WriteByte(0)
+			w.WriteByte(srsItemIPCIDR)
+			w.WriteByte(1)
+			binary.Write(w, binary.BigEndian, uint64(1<<62))
+		},
+		"bad ip length": func(w *srsWriter) {
+			w.uvarint(1)
+			w.WriteByte(0)
+			w.WriteByte(srsItemIPCIDR)
+			w.WriteByte(1)
+			binary.Write(w, binary.BigEndian, uint64(1))
+			w.uvarint(5)
+			w.Write(make([]byte, 5))
+		},
+		"deep logical rules": func(w *srsWriter) {
+			w.uvarint(1)
+			for i := 0; i < maxSRSDepth+1; i++ {
+				w.WriteByte(1)
+				w.WriteByte(0)
+				w.uvarint(1)
+			}
+		},
+		"truncated": func(w *srsWriter) {
+			w.uvarint(2)
+			w.WriteByte(0)
+			w.endRule()
+		},
+	}
+	for name, build := range tests {
+		var w srsWriter
+		build(&w)
+		if _, err := parseRuleSet(RuleSetSingBox, srsFile(t, w.Bytes())); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := parseRuleSet(RuleSetSingBox, []byte("SRS\x09")); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+// 解压后超过大小上限的规则集返回错误，不会读取全部内容
+func TestParseRuleSetSRSDecompressionLimit(t *testing.T) {
+	var w srsWriter
+	w.uvarint(1)
+	w.WriteByte(0)
+	w.WriteByte(srsItemDomainKeyword)
+	count := maxSRSSize/2 + 1
+	w.uvarint(uint64(count))
+	w.Write(bytes.Repeat([]byte{1, 'a'}, count))
+	w.endRule()
+	content := srsFile(t, w.Bytes())
+	_, err := parseRuleSet(RuleSetSingBox, content)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("err = %v, want size limit error", err)
+	}
+}
+
+func TestRangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     []string
+	}{
+		{"10.0.0.0", "10.255.255.255", []string{"10.0.0.0/8"}},
+		{"10.0.0.1", "10.0.0.1", []string{"10.0.0.1/32"}},
+		{"10.0.0.1", "10.0.0.6", []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{"0.0.0.0", "255.255.255.255", []string{"0.0.0.0/0"}},
+		{"255.255.255.254", "255.255.255.255", []string{"255.255.255.254/31"}},
+		{"255.255.255.255", "255.255.255.255", []string{"255.255.255.255/32"}},
+		{"10.0.0.2", "10.0.0.1", nil},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", []string{"::/0"}},
+		{"2001:db8::", "2001:db8::1:0", []string{"2001:db8::/112", "2001:db8::1:0/128"}},
+	}
+	for _, tt := range tests {
+		got := rangeToCIDRs(netip.MustParseAddr(tt.from), netip.MustParseAddr(tt.to))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("rangeToCIDRs(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+// 远程规则集下载后写入缓存，重新启动时在更新间隔内直接使用缓存
+func TestRuleSetRefreshAndCache(t *testing.T) {
+	var requests atomic.Int32
+	content := "example.com\n10.0.0.0/8\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	dir := RuleSetDir
+	RuleSetDir = t.TempDir()
+	defer func() { RuleSetDir = dir }()
+
+	config := db.RuleSet{ID: "remote-test", Format: RuleSetList, Source: server.URL + "/list.txt", Interval: 3600}
+	s := &ruleSet{config: config}
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.status(); got.Entries != 2 || got.Error != "" {
+		t.Errorf("status = %+v, want 2 entries", got)
+	}
+	cached, err := os.ReadFile(s.cachePath())
+	if err != nil || string(cached) != content {
+		t.Fatalf("cache = %q, %v", cached, err)
+	}
+
+	restarted := &ruleSet{config: config}
+	if !restarted.loadCache() {
+		t.Error("cache within interval should be fresh")
+	}
+	if data := restarted.load(); data == nil || data.count() != 2 {
+		t.Errorf("cached data = %+v", data)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+
+	//下载失败时保留原有内容并记录错误
+	server.Close()
+	if err := s.refresh(); err == nil {
+		t.Error("expected refresh error after server closed")
+	}
+	if got := s.status(); got.Entries != 2 || got.Error == "" {
+		t.Errorf("status after failed refresh = %+v", got)
+	}
+}
+
+func assertRuleSetData(t *testing.T, got, want *ruleSetData) {
+	t.Helper()
+	for _, field := range []struct {
+		name      string
+		got, want []string
+	}{
+		{"full", got.Full, want.Full},
+		{"suffix", got.Suffix, want.Suffix},
+		{"subdomain", got.Subdomain, want.Subdomain},
+		{"keyword", got.Keyword, want.Keyword},
+		{"regex", got.Regex, want.Regex},
+		{"cidr", got.CIDR, want.CIDR},
+	} {
+		g, w := slices.Clone(field.got), slices.Clone(field.want)
+		sort.Strings(g)
+		sort.Strings(w)
+		if !slices.Equal(g, w) {
+			t.Errorf("%s = %v, want %v", field.name, field.got, field.want)
+		}
+	}
+}
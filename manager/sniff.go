@@ -0,0 +1,393 @@
+package manager
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/utils"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 协议嗅探：连接目标只有IP地址时(透明代理、raw入站、客户端以IP发起CONNECT等)窥探首部数据，
+// 从TLS ClientHello的SNI、HTTP请求的Host或QUIC Initial包的SNI中得到域名，使domain、geosite等规则可以匹配
+
+const (
+	sniffTimeout   = 300 * time.Millisecond //等待客户端首部数据的时间，服务端先发送数据的协议在超时后按原目标路由，可用sniffSkipPorts跳过这类端口
+	sniffPeekSize  = 4096
+	maxClientHello = 16 << 10
+)
+
+var (
+	httpMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS", "PATCH", "CONNECT", "TRACE"}
+	// QUIC v1 Initial包密钥派生使用的盐值，见RFC 9001 5.2节
+	quicV1Salt = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+)
+
+// 读取入站代理的嗅探配置，目标已有域名或目标端口在sniffSkipPorts中时不需要嗅探。
+// Fake-IP由调用方在嗅探前还原
+func sniffConfig(inbound proxy.Inbound, target *proxy.TargetAddr) (enabled, override bool) {
+	config := inbound.Config()
+	enabled, _ = config["sniff"].(bool)
+	override, _ = config["sniffOverride"].(bool)
+	return enabled && target.Hostname == "" && !sniffSkipPort(config, target.Port), override
+}
+
+// 目标端口是否在sniffSkipPorts中，列表项为端口号或"起始-结束"形式的端口范围，无效的项忽略
+func sniffSkipPort(config map[string]interface{}, port int) bool {
+	list, _ := config["sniffSkipPorts"].([]interface{})
+	for _, v := range list {
+		var pattern string
+		switch v := v.(type) {
+		case float64:
+			pattern = strconv.Itoa(int(v))
+		case string:
+			pattern = v
+		default:
+			continue
+		}
+		if from, to, err := parsePortRange(pattern); err == nil && port >= from && port <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据嗅探到的域名得到路由使用的目标。开启sniffOverride时以域名替换连接目标，由出站代理解析域名；
+// 否则仅在路由时使用域名，仍然连接原目标地址
+func sniffedTarget(target *proxy.TargetAddr, host string, override bool) *proxy.TargetAddr {
+	if override {
+		target.Hostname, target.IP = host, nil
+		return target
+	}
+	routeTarget := *target
+	routeTarget.Hostname = host
+	return &routeTarget
+}
+
+// 对TCP连接进行协议嗅探，返回保留已窥探数据的入站连接与路由使用的目标
+func sniffConn(inbound proxy.Inbound, conn net.Conn, target *proxy.TargetAddr) (net.Conn, *proxy.TargetAddr) {
+	enabled, override := sniffConfig(inbound, target)
+	if !enabled {
+		return conn, target
+	}
+	peekConn := utils.NewPeekConn(conn)
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host := sniffStream(peekConn)
+	conn.SetReadDeadline(time.Time{})
+	if host == "" {
+		return peekConn, target
+	}
+	log.Printf("Sniffed %s for %s@%s ---> %s", host, target.UserId, inbound.Name(), target)
+	return peekConn, sniffedTarget(target, host, override)
+}
+
+// 对UDP会话的首个数据包进行QUIC嗅探，返回路由使用的目标
+func sniffPacket(inbound proxy.Inbound, payload []byte, target *proxy.TargetAddr) *proxy.TargetAddr {
+	enabled, override := sniffConfig(inbound, target)
+	if !enabled {
+		return target
+	}
+	host := sniffQUIC(payload)
+	if host == "" {
+		return target
+	}
+	log.Printf("Sniffed %s for %s@%s ---> udp:%s", host, target.UserId, inbound.Name(), target)
+	return sniffedTarget(target, host, override)
+}
+
+func sniffStream(conn *utils.PeekConn) string {
+	data, err := conn.Peek(sniffPeekSize)
+	if len(data) == 0 {
+		return ""
+	}
+	if isClientHelloRecord(data) {
+		//ClientHello可能分多个TCP分段到达，按记录长度继续读取
+		need := 5 + int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < need && err == nil {
+			data, _ = conn.PeekAtLeast(need)
+		}
+		return sniffTLS(data)
+	}
+	return sniffHTTP(data)
+}
+
+// 判断记录头是否为TLS握手消息：type(1), version(2), length(2)
+func isClientHelloRecord(header []byte) bool {
+	if len(header) < 5 || header[0] != 0x16 { // 必须是 handshake 消息
+		return false
+	}
+	// 协议版本 >= SSLv3 （0x0300），有些客户端仍用 0x0300
+	if binary.BigEndian.Uint16(header[1:3]) < 0x0300 {
+		return false
+	}
+	// 整个 ClientHello 至少需要 39 字节以上（handshake 头 + client hello 固定字段）
+	return binary.BigEndian.Uint16(header[3:5]) > 39
+}
+
+// 拼接连续TLS握手记录的内容，从中解析ClientHello的SNI
+func sniffTLS(data []byte) string {
+	var msg []byte
+	for len(data) >= 5 && data[0] == 0x16 && len(msg) < maxClientHello {
+		n := min(int(binary.BigEndian.Uint16(data[3:5])), len(data)-5)
+		msg = append(msg, data[5:5+n]...)
+		data = data[5+n:]
+	}
+	return parseClientHelloSNI(msg)
+}
+
+// 读取长度前缀的字段，数据被截断时返回剩余的全部数据
+func readTruncated(s *cryptobyte.String, n int) cryptobyte.String {
+	var out []byte
+	s.ReadBytes(&out, min(n, len(*s)))
+	return out
+}
+
+// 解析握手消息中ClientHello的server_name扩展。消息可以被截断，只要SNI扩展完整即可解析
+func parseClientHelloSNI(msg []byte) string {
+	s := cryptobyte.String(msg)
+	var msgType uint8
+	var length uint32
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24(&length) {
+		return ""
+	}
+	body := readTruncated(&s, int(length))
+	var sessionID, cipherSuites, compression cryptobyte.String
+	var extLength uint16
+	if !body.Skip(2+32) || // client_version, random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compression) ||
+		!body.ReadUint16(&extLength) {
+		return ""
+	}
+	extensions := readTruncated(&body, int(extLength))
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		if extType != 0 { // server_name
+			continue
+		}
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 { // host_name
+				return validSniffedHost(string(name))
+			}
+		}
+	}
+	return ""
+}
+
+// 从HTTP/1.x请求头中解析Host，只使用已完整接收的行
+func sniffHTTP(data []byte) string {
+	lines := strings.Split(string(data), "\r\n")
+	lines = lines[:len(lines)-1]
+	if len(lines) == 0 {
+		return ""
+	}
+	method, rest, ok := strings.Cut(lines[0], " ")
+	if !ok || !slices.Contains(httpMethods, method) || !strings.Contains(rest, " HTTP/1.") {
+		return ""
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validSniffedHost(host)
+	}
+	return ""
+}
+
+// 检查嗅探到的主机名，IP地址或包含非法字符时忽略
+func validSniffedHost(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return ""
+		}
+	}
+	return host
+}
+
+// 解密QUIC v1客户端Initial包(RFC 9001 5节)，从CRYPTO帧携带的ClientHello中解析SNI。
+// 只使用当前数据包，ClientHello分布在多个数据包中且SNI不在首个数据包时无法嗅探
+func sniffQUIC(packet []byte) string {
+	s := cryptobyte.String(packet)
+	var first uint8
+	var version uint32
+	var dcid, scid cryptobyte.String
+	// 长包头且类型为Initial
+	if !s.ReadUint8(&first) || first&0xc0 != 0xc0 || first&0x30 != 0 ||
+		!s.ReadUint32(&version) || version != 1 ||
+		!s.ReadUint8LengthPrefixed(&dcid) || !s.ReadUint8LengthPrefixed(&scid) {
+		return ""
+	}
+	tokenLength, ok := readQUICVarint(&s)
+	if !ok || !s.Skip(int(tokenLength)) {
+		return ""
+	}
+	length, ok := readQUICVarint(&s)
+	if !ok || length < 20 || length > uint64(len(s)) {
+		return ""
+	}
+	pnOffset := len(packet) - len(s)
+
+	initialSecret := hkdf.Extract(sha256.New, dcid, quicV1Salt)
+	clientSecret := hkdfExpandLabel(initialSecret, "client in", 32)
+	key := hkdfExpandLabel(clientSecret, "quic key", 16)
+	iv := hkdfExpandLabel(clientSecret, "quic iv", 12)
+	hp := hkdfExpandLabel(clientSecret, "quic hp", 16)
+
+	//去除包头保护，采样位置为包号字段后4字节
+	hpBlock, err := aes.NewCipher(hp)
+	if err != nil {
+		return ""
+	}
+	mask := make([]byte, aes.BlockSize)
+	hpBlock.Encrypt(mask, packet[pnOffset+4:pnOffset+4+aes.BlockSize])
+	header := slices.Clone(packet[:pnOffset+4])
+	header[0] ^= mask[0] & 0x0f
+	pnLength := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLength; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLength]
+
+	nonce := slices.Clone(iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ""
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return ""
+	}
+	payload, err := aead.Open(nil, nonce, packet[pnOffset+pnLength:pnOffset+int(length)], header)
+	if err != nil {
+		return ""
+	}
+	return parseClientHelloSNI(quicCryptoData(payload))
+}
+
+// 按偏移拼接Initial包中CRYPTO帧的数据，返回从偏移0开始连续的部分
+func quicCryptoData(payload []byte) []byte {
+	type fragment struct {
+		offset uint64
+		data   []byte
+	}
+	var fragments []fragment
+	frames := cryptobyte.String(payload)
+	for !frames.Empty() {
+		frameType, ok := readQUICVarint(&frames)
+		if !ok {
+			break
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+			continue
+		case 0x02, 0x03: // ACK
+			var v [4]uint64
+			for i := range v {
+				v[i], ok = readQUICVarint(&frames)
+			}
+			for i := uint64(0); ok && i < 2*v[2]; i++ {
+				_, ok = readQUICVarint(&frames)
+			}
+			for i := 0; ok && frameType == 0x03 && i < 3; i++ {
+				_, ok = readQUICVarint(&frames)
+			}
+			if ok {
+				continue
+			}
+		case 0x06: // CRYPTO
+			offset, ok1 := readQUICVarint(&frames)
+			length, ok2 := readQUICVarint(&frames)
+			var data []byte
+			if ok1 && ok2 && offset < maxClientHello && frames.ReadBytes(&data, int(length)) {
+				fragments = append(fragments, fragment{offset, data})
+				continue
+			}
+		}
+		break
+	}
+	slices.SortFunc(fragments, func(a, b fragment) int {
+		return int(a.offset) - int(b.offset)
+	})
+	var data []byte
+	for _, f := range fragments {
+		if f.offset > uint64(len(data)) {
+			break
+		}
+		if end := f.offset + uint64(len(f.data)); end > uint64(len(data)) {
+			data = append(data, f.data[uint64(len(data))-f.offset:]...)
+		}
+	}
+	return data
+}
+
+// 读取QUIC变长整数，前两位表示长度
+func readQUICVarint(s *cryptobyte.String) (uint64, bool) {
+	var b uint8
+	if !s.ReadUint8(&b) {
+		return 0, false
+	}
+	v := uint64(b & 0x3f)
+	var rest []byte
+	if !s.ReadBytes(&rest, 1<<(b>>6)-1) {
+		return 0, false
+	}
+	for _, c := range rest {
+		v = v<<8 | uint64(c)
+	}
+	return v, true
+}
+
+// TLS 1.3 HKDF-Expand-Label
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, b.BytesOrPanic()), out)
+	return out
+}
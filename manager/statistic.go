@@ -73,7 +73,7 @@ func LaunchRealTimeStatistic() {
 func GetRealTimeTraffic() (uint64, uint64, uint64) {
 	return SumDownload, SumUpload, SumDownload + SumDownload
 }
-func (s *StatisticIO) AddToDB(inboundID, outboundID, userID, destAddr string, tm time.Time) {
+func (s *StatisticIO) AddToDB(inboundID, outboundID, userID, sourceAddr, destAddr string, tm time.Time) {
 	StatisticDBM.Traffic.Create(&db.Traffic{
 		InboundID:  inboundID,
 		OutboundID: outboundID,
@@ -81,6 +81,7 @@ func (s *StatisticIO) AddToDB(inboundID, outboundID, userID, destAddr string, tm
 		BytesIn:    s.BytesIn,
 		BytesOut:   s.BytesOut,
 		Time:       tm,
+		SourceAddr: sourceAddr,
 		DestAddr:   destAddr,
 	})
 }
@@ -7,7 +7,6 @@ import (
 	stdtls "crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -94,28 +93,7 @@ func isTLSClientHello(conn *utils.PeekConn) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-
-	if header[0] != 0x16 { // 必须是 handshake 消息
-		return false, nil
-	}
-
-	// 协议版本 >= TLS 1.0 （0x0301）
-	// 可选判断，有些客户端仍用 0x0300（SSLv3）
-	version := binary.BigEndian.Uint16(header[1:3])
-	if version < 0x0300 {
-		return false, nil
-	}
-
-	// 消息总长度（注意：这是整个 handshake 消息的长度）
-	msgLen := binary.BigEndian.Uint16(header[3:5])
-
-	// 整个 ClientHello 至少需要 39 字节以上（handshake 头 + client hello 固定字段）
-	// 所以如果 total len <= 39，不合法
-	if msgLen <= 39 {
-		return false, nil
-	}
-
-	return true, nil
+	return isClientHelloRecord(header), nil
 }
 func InitTlsMITM(caCertPath, caKeyPath string) error {
 
@@ -0,0 +1,219 @@
+package manager
+
+import (
+	"errors"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/db"
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+const (
+	udpSessionIdleTimeout = 60 * time.Second
+	udpSessionCheckPeriod = 5 * time.Second
+)
+
+// UDP会话，一个入站关联内每个代理目标对应一个会话，拥有独立的出站套接字
+type udpSession struct {
+	target     *proxy.TargetAddr
+	srcAddr    string
+	outbound   proxy.Outbound
+	outConn    proxy.PacketConn
+	closeChan  chan struct{}
+	done       chan struct{} //会话关闭时关闭，通知等待出站代理关闭的协程退出
+	startTime  time.Time
+	lastActive time.Time
+	bytesIn    uint64
+	bytesOut   uint64
+	mu         sync.Mutex
+	closeOnce  sync.Once
+}
+
+func (s *udpSession) active() {
+	s.mu.Lock()
+	s.lastActive = time.Now()
+	s.mu.Unlock()
+}
+func (s *udpSession) idle() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastActive)
+}
+
+// 通过路由模块为代理目标匹配出站代理，建立UDP会话并启动回程转发协程。payload为会话的首个数据包，用于QUIC嗅探
+func newUDPSession(inbound proxy.Inbound, inConn proxy.PacketConn, srcAddr string, target *proxy.TargetAddr, payload []byte) (*udpSession, error) {
+	restoreFakeIP(target)
+	routeTarget := sniffPacket(inbound, payload, target)
+	outboundName := RouteOutbound(routeTarget, inbound.Name(), addrIP(srcAddr))
+	val, ok := resolveOutbound(outboundName, routeTarget)
+	if !ok {
+		if outboundName == "block" {
+			log.Printf("Block %s@%s ---> udp:%s\t\tNow Goroutine:%d", target.UserId, inbound.Name(), target, runtime.NumGoroutine())
+			return nil, errors.New("blocked")
+		}
+		return nil, errors.New("outbound " + outboundName + " not found")
+	}
+	outbound, ok := val.(proxy.PacketOutbound)
+	if !ok {
+		return nil, errors.New("outbound " + outboundName + " does not support udp")
+	}
+	underlay, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	outConn, closeChan, err := outbound.WrapPacketConn(underlay, target)
+	if err != nil {
+		underlay.Close()
+		outbound.UnregCloseChan(closeChan)
+		return nil, err
+	}
+	s := &udpSession{
+		target:     target,
+		srcAddr:    srcAddr,
+		outbound:   outbound,
+		outConn:    outConn,
+		closeChan:  closeChan,
+		done:       make(chan struct{}),
+		startTime:  time.Now().Truncate(time.Second),
+		lastActive: time.Now(),
+	}
+	addActiveUserLink(target.UserId)
+	log.Printf("Start %s@%s ---> %s ---> udp:%s\t\tfrom %s\tNow Goroutine:%d", target.UserId, inbound.Name(), outbound.Name(), target, srcAddr, runtime.NumGoroutine())
+	//回程转发协程，将代理目标返回的数据包写回入站关联
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := outConn.ReadPacket(buf)
+			if err != nil {
+				return
+			}
+			if _, err := inConn.WritePacket(buf[:n], from); err != nil {
+				return
+			}
+			s.active()
+			s.mu.Lock()
+			s.bytesIn += uint64(n)
+			s.mu.Unlock()
+			downloadCollect <- uint64(n)
+		}
+	}()
+	//出站代理实例关闭时结束会话
+	go func() {
+		select {
+		case <-closeChan:
+			s.outConn.Close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+func (s *udpSession) write(b []byte) error {
+	if _, err := s.outConn.WritePacket(b, s.target); err != nil {
+		return err
+	}
+	s.active()
+	s.mu.Lock()
+	s.bytesOut += uint64(len(b))
+	s.mu.Unlock()
+	uploadCollect <- uint64(len(b))
+	return nil
+}
+
+// 关闭会话并将流量统计信息记录到数据库
+func (s *udpSession) close(inbound proxy.Inbound, reason string) {
+	s.closeOnce.Do(func() {
+		s.outConn.Close()
+		close(s.done)
+		s.outbound.UnregCloseChan(s.closeChan)
+		subActiveUserLink(s.target.UserId)
+		s.mu.Lock()
+		traffic := &db.Traffic{
+			InboundID:  inbound.Name(),
+			OutboundID: s.outbound.Name(),
+			UserID:     s.target.UserId,
+			BytesIn:    s.bytesIn,
+			BytesOut:   s.bytesOut,
+			Time:       s.startTime,
+			SourceAddr: s.srcAddr,
+			DestAddr:   s.target.String(),
+		}
+		s.mu.Unlock()
+		StatisticDBM.Traffic.Create(traffic)
+		log.Printf("End   %s@%s ---> %s ---> udp:%s\t\tdue to %s\tNow Goroutine:%d", s.target.UserId, inbound.Name(), s.outbound.Name(), s.target, reason, runtime.NumGoroutine())
+	})
+}
+
+// UDP转发处理，维护入站关联内的会话表，空闲超时的会话会被回收
+func packetProcess(inbound proxy.Inbound, inConn proxy.PacketConn, userId, srcAddr string, inCloseChan chan struct{}) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	done := make(chan struct{})
+	defer close(done)
+
+	//会话表清理协程
+	go func() {
+		ticker := time.NewTicker(udpSessionCheckPeriod)
+		defer ticker.Stop()
+		reason := "association finished"
+		for {
+			select {
+			case <-ticker.C:
+				mu.Lock()
+				for key, s := range sessions {
+					if s.idle() > udpSessionIdleTimeout {
+						s.close(inbound, "no data transfer in "+udpSessionIdleTimeout.String())
+						delete(sessions, key)
+					}
+				}
+				mu.Unlock()
+				continue
+			case <-inCloseChan:
+				reason = "inbound closed"
+				inConn.Close()
+			case <-done:
+			}
+			break
+		}
+		mu.Lock()
+		for key, s := range sessions {
+			s.close(inbound, reason)
+			delete(sessions, key)
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, target, err := inConn.ReadPacket(buf)
+		if err != nil {
+			return
+		}
+		target.UserId = userId
+		key := target.String()
+		mu.Lock()
+		s, ok := sessions[key]
+		mu.Unlock()
+		if !ok {
+			s, err = newUDPSession(inbound, inConn, srcAddr, target, buf[:n])
+			if err != nil {
+				log.Printf("udp %s@%s ---> %s fail: %v", userId, inbound.Name(), target, err)
+				continue
+			}
+			mu.Lock()
+			sessions[key] = s
+			mu.Unlock()
+		}
+		if err := s.write(buf[:n]); err != nil {
+			log.Println("udp write out packet ", err)
+			mu.Lock()
+			s.close(inbound, "outbound closed")
+			delete(sessions, key)
+			mu.Unlock()
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -30,12 +31,69 @@ type Inbound interface {
 	//关闭该入站代理实例，除了关闭上述相关连接外，还会停止相关监听协程。
 	Stop()
 }
+
+// 需要设置监听套接字参数的入站代理实现该接口，如tproxy透明代理需要IP_TRANSPARENT
+type ListenConfigInbound interface {
+	Inbound
+	ListenConfig() *net.ListenConfig
+}
+
+// DNS查询处理函数，接受原始查询报文和客户端地址，返回原始响应报文，返回nil时不做响应
+type DNSHandler func(msg []byte, src net.Addr) []byte
+
+// DNS服务器入站代理实现该接口，由入站代理自行监听UDP和TCP并解析报文，查询交由manager提供的处理函数路由。
+// 返回的Listener关闭时停止服务
+type DNSInbound interface {
+	Inbound
+	ServeDNS(handler DNSHandler) (net.Listener, error)
+}
+
 type InboundCreator func(name string, config map[string]interface{}) (Inbound, error)
 
 var (
 	InboundMap = make(map[string]InboundCreator)
 )
 
+// 获取所有已启用用户linkToken的回调，由manager模块注入。
+// Shadowsocks等以密钥区分用户的协议据此建立查找表，确定连接所属用户后再交由认证回调函数处理。
+var LinkTokens = func() []string { return nil }
+
+// 查询用户是否存在且已启用的回调，由manager模块注入。
+// 透明代理等由入站代理自身配置确定用户的连接据此校验，不经过认证回调函数，客户端无法伪造
+var UserEnabled = func(userId string) bool { return false }
+
+// 用户linkToken集合的版本号，manager在用户同步后调用LinkTokensChanged递增
+var linkTokenVersion atomic.Uint64
+
+func LinkTokensChanged() {
+	linkTokenVersion.Add(1)
+}
+
+// TokenTable 由所有用户linkToken预先计算的查找表，如密钥表、密码摘要表。
+// 用户同步后在下次访问时整体重建，已删除用户的条目随之丢弃
+type TokenTable[T any] struct {
+	build   func(tokens []string) T
+	mu      sync.Mutex
+	built   bool
+	version uint64
+	table   T
+}
+
+func NewTokenTable[T any](build func(tokens []string) T) *TokenTable[T] {
+	return &TokenTable[T]{build: build}
+}
+
+func (t *TokenTable[T]) Load() T {
+	version := linkTokenVersion.Load()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.built || t.version != version {
+		t.table = t.build(LinkTokens())
+		t.built, t.version = true, version
+	}
+	return t.table
+}
+
 func RegisterInbound(scheme string, c InboundCreator) {
 	InboundMap[scheme] = c
 }
@@ -80,6 +138,22 @@ type Outbound interface {
 	//通过广播连接关闭消息通道的方式，关闭该出站代理实例所有相关连接。
 	CloseAllConn()
 }
+
+// 支持UDP转发的出站代理实现该接口
+type PacketOutbound interface {
+	Outbound
+	//出站代理数据包包装器方法，接受下层UDP套接字和首个数据包的代理目标进行处理；返回包装后数据包连接、已注册的连接关闭消息通道、错误信息。
+	WrapPacketConn(underlay net.PacketConn, target *TargetAddr) (PacketConn, chan struct{}, error)
+}
+
+// 数据包连接，每个数据包均携带代理目标(写入)或来源地址(读出)。
+// 入站代理WrapConn返回的连接如果同时实现了该接口，则按UDP转发处理，如SOCKS5的UDP ASSOCIATE请求。
+type PacketConn interface {
+	ReadPacket(b []byte) (int, *TargetAddr, error)
+	WritePacket(b []byte, addr *TargetAddr) (int, error)
+	Close() error
+}
+
 type OutboundCreator func(name string, config map[string]interface{}) (Outbound, error)
 
 var (
@@ -117,7 +191,7 @@ func UpperOutboundCreate(out Outbound, config map[string]interface{}) (Outbound,
 
 type TargetAddr struct {
 	Hostname string // fully-qualified domain name
-	IP       net.IP
+	IP       net.IP // 目标为域名时在需要时才解析，未解析时为nil
 	Port     int
 	UserId   string
 	Custom   map[string]interface{}
@@ -150,16 +224,26 @@ func NewTargetAddr(addr string) (*TargetAddr, error) {
 		target.Hostname = ""
 	} else {
 		target.Hostname = host
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			target.IP = nil
-		} else {
-			target.IP = ips[0]
-		}
 	}
 	return target, nil
 }
 
+// 域名解析函数，由manager模块注入配置的DNS解析器
+var LookupIP = net.LookupIP
+
+// ResolveIP 解析代理目标域名，结果保存在IP字段中，已解析或目标为IP地址时直接返回
+func (a *TargetAddr) ResolveIP() (net.IP, error) {
+	if a.IP != nil || a.Hostname == "" {
+		return a.IP, nil
+	}
+	ips, err := LookupIP(a.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	a.IP = ips[0]
+	return a.IP, nil
+}
+
 func UnregCloseChan(closeChanSet *sync.Map, closeChan chan struct{}) {
 	if _, ok := closeChanSet.Load(closeChan); ok {
 		closeChanSet.Delete(closeChan)
@@ -0,0 +1,38 @@
+package direct
+
+import (
+	"net"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// 直连UDP数据包连接，直接向代理目标收发数据包
+type packetConn struct {
+	net.PacketConn
+}
+
+func (c *packetConn) ReadPacket(b []byte) (int, *proxy.TargetAddr, error) {
+	n, addr, err := c.ReadFrom(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return n, &proxy.TargetAddr{}, nil
+	}
+	return n, &proxy.TargetAddr{IP: udpAddr.IP, Port: udpAddr.Port}, nil
+}
+
+func (c *packetConn) WritePacket(b []byte, target *proxy.TargetAddr) (int, error) {
+	ip, err := target.ResolveIP()
+	if err != nil {
+		return 0, err
+	}
+	return c.WriteTo(b, &net.UDPAddr{IP: ip, Port: target.Port})
+}
+
+func (out *Outbound) WrapPacketConn(underlay net.PacketConn, target *proxy.TargetAddr) (proxy.PacketConn, chan struct{}, error) {
+	closeChan := make(chan struct{})
+	out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	return &packetConn{PacketConn: underlay}, closeChan, nil
+}
@@ -0,0 +1,43 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+const scheme = "dns"
+
+const maxUDPSize = 65535
+
+// 读取TCP连接中带两字节长度前缀的DNS报文
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := conn.Write(b)
+	return err
+}
+
+// UDP与TCP共用的监听器，关闭时同时关闭UDP套接字
+type listener struct {
+	net.Listener
+	udp net.PacketConn
+}
+
+func (l *listener) Close() error {
+	l.udp.Close()
+	return l.Listener.Close()
+}
@@ -0,0 +1,157 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// TCP连接无查询时的关闭时间
+const tcpIdleTimeout = 30 * time.Second
+
+type Inbound struct {
+	addr         string
+	name         string
+	config       map[string]interface{}
+	closeChanSet sync.Map
+}
+
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+
+// DNS服务器不支持叠加上层协议
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, DNSInboundCreator)
+}
+
+// DNS服务器入站代理实例的创建函数，查询的路由方式见manager模块的DNS查询处理
+func DNSInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	return &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+	}, nil
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+}
+
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	return nil, nil, nil, errors.New("dns inbound serves queries by itself")
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	return map[string]interface{}{
+		"scheme":  scheme,
+		"address": proxy.GetLinkAddr(in, defaultAccessAddr),
+	}
+}
+
+// 同时监听UDP和TCP，每个查询在单独的协程中交由handler处理
+func (in *Inbound) ServeDNS(handler proxy.DNSHandler) (net.Listener, error) {
+	udpConn, err := net.ListenPacket("udp", in.addr)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, err := net.Listen("tcp", in.addr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	go in.serveUDP(udpConn, handler)
+	go in.serveTCP(tcpListener, handler)
+	return &listener{Listener: tcpListener, udp: udpConn}, nil
+}
+
+func (in *Inbound) serveUDP(conn net.PacketConn, handler proxy.DNSHandler) {
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		go func() {
+			if resp := handler(msg, addr); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (in *Inbound) serveTCP(l net.Listener, handler proxy.DNSHandler) {
+	log.Printf("Inbound %s dns server listening on %s", in.name, in.addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("Inbound %s process end", in.name)
+				in.Stop()
+				return
+			}
+			continue
+		}
+		go in.serveTCPConn(conn, handler)
+	}
+}
+
+// 同一TCP连接上的查询按顺序处理
+func (in *Inbound) serveTCPConn(conn net.Conn, handler proxy.DNSHandler) {
+	closeChan := make(chan struct{})
+	in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	defer in.UnregCloseChan(closeChan)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-closeChan:
+		case <-done:
+		}
+		conn.Close()
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := handler(msg, conn.RemoteAddr())
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
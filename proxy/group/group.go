@@ -0,0 +1,38 @@
+package group
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+const scheme = "group"
+
+// 出站代理分组的选择策略
+const (
+	StrategyURLTest        = "url-test"        //选择延迟最低的出站代理
+	StrategyFallback       = "fallback"        //按顺序选择第一个可用的出站代理
+	StrategyRoundRobin     = "round-robin"     //在可用出站代理之间轮询
+	StrategyConsistentHash = "consistent-hash" //按代理目标主机或用户固定选择出站代理
+)
+
+const defaultCheckInterval = time.Minute //默认健康检查间隔
+
+// 出站代理的健康状态，未检查过的出站代理视为可用
+type health struct {
+	checked bool
+	alive   bool
+	latency int64
+}
+
+func (h health) available() bool {
+	return !h.checked || h.alive
+}
+
+// 最高随机权重哈希，可用出站代理增减时只有相关的键会改变选择结果
+func hashWeight(key, member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(member))
+	return h.Sum64()
+}
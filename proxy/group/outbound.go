@@ -0,0 +1,168 @@
+package group
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+type Outbound struct {
+	name         string
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	strategy     string
+	hashBy       string
+	members      []string
+	interval     time.Duration
+	counter      atomic.Uint64
+	healthMu     sync.RWMutex
+	health       map[string]health
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return scheme }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, GroupOutboundCreator)
+}
+
+// 出站代理分组实例的创建函数，分组本身不处理流量，由manager按策略从成员中选出实际使用的出站代理
+func GroupOutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	list, _ := config["outbounds"].([]interface{})
+	var members []string
+	for _, v := range list {
+		if member, ok := v.(string); ok && member != name {
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("outbounds is required")
+	}
+	strategy, _ := config["strategy"].(string)
+	switch strategy {
+	case "":
+		strategy = StrategyURLTest
+	case StrategyURLTest, StrategyFallback, StrategyRoundRobin, StrategyConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown strategy %s", strategy)
+	}
+	hashBy, _ := config["hashBy"].(string)
+	switch hashBy {
+	case "":
+		hashBy = "host"
+	case "host", "user":
+	default:
+		return nil, fmt.Errorf("unknown hashBy %s", hashBy)
+	}
+	interval := defaultCheckInterval
+	if v, ok := config["interval"].(float64); ok && v > 0 {
+		interval = time.Duration(v) * time.Second
+	}
+	return &Outbound{
+		name:     name,
+		config:   config,
+		strategy: strategy,
+		hashBy:   hashBy,
+		members:  members,
+		interval: interval,
+		health:   make(map[string]health),
+	}, nil
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+}
+func (out *Outbound) CloseAllConn() {
+	proxy.CloseAllConn(&out.closeChanSet)
+}
+
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	return nil, nil, fmt.Errorf("group %s must be resolved to a member outbound", out.name)
+}
+
+// Members 返回分组成员出站代理ID，按配置顺序排列
+func (out *Outbound) Members() []string {
+	return out.members
+}
+
+// Interval 返回健康检查间隔
+func (out *Outbound) Interval() time.Duration {
+	return out.interval
+}
+
+// SetHealth 记录成员出站代理的健康检查结果
+func (out *Outbound) SetHealth(member string, latency int64, err error) {
+	out.healthMu.Lock()
+	out.health[member] = health{checked: true, alive: err == nil, latency: latency}
+	out.healthMu.Unlock()
+}
+
+// Select 按策略为代理目标选择成员出站代理，exists用于排除已被删除的成员。
+// 所有成员均不可用时忽略健康状态，仍按策略选择，没有成员时返回空字符串
+func (out *Outbound) Select(target *proxy.TargetAddr, exists func(string) bool) string {
+	var candidates, healthy []string
+	out.healthMu.RLock()
+	for _, member := range out.members {
+		if !exists(member) {
+			continue
+		}
+		candidates = append(candidates, member)
+		if out.health[member].available() {
+			healthy = append(healthy, member)
+		}
+	}
+	out.healthMu.RUnlock()
+	if len(healthy) > 0 {
+		candidates = healthy
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	switch out.strategy {
+	case StrategyURLTest:
+		selected := candidates[0]
+		var minLatency int64 = -1
+		out.healthMu.RLock()
+		for _, member := range candidates {
+			h := out.health[member]
+			if h.checked && h.alive && (minLatency < 0 || h.latency < minLatency) {
+				selected, minLatency = member, h.latency
+			}
+		}
+		out.healthMu.RUnlock()
+		return selected
+	case StrategyRoundRobin:
+		return candidates[(out.counter.Add(1)-1)%uint64(len(candidates))]
+	case StrategyConsistentHash:
+		key := target.UserId
+		if out.hashBy == "host" {
+			key = target.Hostname
+			if key == "" {
+				key = target.IP.String()
+			}
+		}
+		selected := candidates[0]
+		var maxWeight uint64
+		for _, member := range candidates {
+			if w := hashWeight(key, member); w >= maxWeight {
+				selected, maxWeight = member, w
+			}
+		}
+		return selected
+	default:
+		return candidates[0]
+	}
+}
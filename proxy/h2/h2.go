@@ -0,0 +1,141 @@
+package h2
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	schemeH2   = "h2"
+	schemeGrpc = "grpc"
+
+	defaultServiceName = "GunService"
+	grpcContentType    = "application/grpc"
+	maxMessageSize     = 1 << 20
+)
+
+var (
+	errBadMessage   = errors.New("grpc: bad message")
+	errStreamClosed = errors.New("h2: stream closed")
+)
+
+func configString(config map[string]interface{}, key, def string) string {
+	if v, ok := config[key].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// 请求路径，gRPC模式兼容Gun传输的 /<serviceName>/Tun 方法
+func streamPath(scheme string, config map[string]interface{}) string {
+	if scheme == schemeGrpc {
+		return "/" + configString(config, "serviceName", defaultServiceName) + "/Tun"
+	}
+	return configString(config, "path", "/")
+}
+
+// 单个HTTP/2流构成的IO流，读方向为对端发送的DATA帧，写方向为本端发送的DATA帧。
+// gRPC模式下每次写入封装为一条gRPC消息，消息体为protobuf编码的Hunk{bytes data = 1}。
+type streamConn struct {
+	reader    io.ReadCloser
+	writer    io.Writer
+	flush     func()
+	closeFunc func()
+	grpc      bool
+	pending   []byte //当前gRPC消息中未读出的数据
+	local     net.Addr
+	remote    net.Addr
+	mu        sync.Mutex
+	closed    bool
+}
+
+func (c *streamConn) readMessage() error {
+	var head [5]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(head[1:])
+	if head[0] != 0 || length > maxMessageSize {
+		return errBadMessage
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, msg); err != nil {
+		return err
+	}
+	//只接受长度分隔类型的字段，取出字段1的数据
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 || tag&7 != 2 {
+			return errBadMessage
+		}
+		msg = msg[n:]
+		size, n := binary.Uvarint(msg)
+		if n <= 0 || size > uint64(len(msg)-n) {
+			return errBadMessage
+		}
+		if tag>>3 == 1 {
+			c.pending = append(c.pending, msg[n:n+int(size)]...)
+		}
+		msg = msg[n+int(size):]
+	}
+	return nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if !c.grpc {
+		return c.reader.Read(b)
+	}
+	for len(c.pending) == 0 {
+		if err := c.readMessage(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errStreamClosed
+	}
+	if c.grpc {
+		frame := make([]byte, 5, 5+1+binary.MaxVarintLen64+len(b))
+		frame = append(frame, 0x0a)
+		frame = binary.AppendUvarint(frame, uint64(len(b)))
+		frame = append(frame, b...)
+		binary.BigEndian.PutUint32(frame[1:5], uint32(len(frame)-5))
+		if _, err := c.writer.Write(frame); err != nil {
+			return 0, err
+		}
+	} else if _, err := c.writer.Write(b); err != nil {
+		return 0, err
+	}
+	if c.flush != nil {
+		c.flush()
+	}
+	return len(b), nil
+}
+
+// 关闭流，此后的写入返回错误。服务端的响应写入器在处理函数返回后不可再使用，因此需在锁内完成
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.closeFunc()
+	}
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr                { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,162 @@
+package h2
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"golang.org/x/net/http2"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	upper        proxy.Inbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	scheme       string
+	path         string
+	server       *http2.Server
+}
+
+func (in *Inbound) Scheme() string                 { return in.scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(schemeH2, H2InboundCreator)
+	proxy.RegisterInbound(schemeGrpc, H2InboundCreator)
+}
+
+// HTTP/2入站代理实例的创建函数，一个下层连接上的每条流作为一条代理连接交由上层协议处理
+func H2InboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	scheme, _ := config["scheme"].(string)
+	in := &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+		scheme: scheme,
+		path:   streamPath(scheme, config),
+		server: &http2.Server{IdleTimeout: sessionIdleTimeout},
+	}
+	_, err := proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+// 会话的关闭消息通道始终注册在本层，各条流的关闭消息通道按上层叠加协议处理
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+	if in.upper != nil {
+		in.upper.UnregCloseChan(closeChan)
+	}
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+	if in.upper != nil {
+		in.upper.CloseAllConn()
+	}
+}
+
+// 处理单条流，完成上层协议处理后提交给manager，直到流关闭才返回
+func (in *Inbound) serveStream(acceptor *proxy.StreamAcceptor, w http.ResponseWriter, r *http.Request, authFunc func(map[string]string) string) {
+	if r.Method != http.MethodPost || r.URL.Path != in.path {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if in.scheme == schemeGrpc {
+		w.Header().Set("Content-Type", grpcContentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher := w.(http.Flusher)
+	flusher.Flush()
+	done := make(chan struct{})
+	stream := &streamConn{
+		reader:    r.Body,
+		writer:    w,
+		flush:     flusher.Flush,
+		closeFunc: func() { close(done) },
+		grpc:      in.scheme == schemeGrpc,
+		local:     acceptor.LocalAddr(),
+		remote:    acceptor.RemoteAddr(),
+	}
+	defer stream.Close()
+
+	var conn net.Conn = stream
+	var target *proxy.TargetAddr
+	var closeChan chan struct{}
+	if in.upper != nil {
+		var err error
+		conn, target, closeChan, err = in.upper.WrapConn(stream, authFunc)
+		if err != nil {
+			log.Printf("inbound %s recieve stream from %s fail", in.name, r.RemoteAddr)
+			return
+		}
+	} else {
+		closeChan = make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	}
+	if !acceptor.Push(conn, target, closeChan) {
+		in.UnregCloseChan(closeChan)
+		return
+	}
+	select {
+	case <-done:
+	case <-r.Context().Done():
+	}
+	if in.scheme == schemeGrpc {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}
+}
+
+// HTTP/2入站代理模块中的IO流包装器函数，在下层连接上运行HTTP/2服务端，返回可逐一接收各条流的多路复用连接
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	acceptor := proxy.NewStreamAcceptor(underlay)
+	go func() {
+		in.server.ServeConn(underlay, &http2.ServeConnOpts{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				in.serveStream(acceptor, w, r, authFunc)
+			}),
+		})
+		acceptor.Close()
+	}()
+	closeChan := make(chan struct{})
+	in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	return acceptor, nil, closeChan, nil
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	config := make(map[string]interface{})
+	config["scheme"] = in.scheme
+	config["address"] = proxy.GetLinkAddr(in, defaultAccessAddr)
+	if in.scheme == schemeGrpc {
+		config["serviceName"] = configString(in.config, "serviceName", defaultServiceName)
+	} else {
+		config["path"] = in.path
+	}
+	if host, ok := in.config["host"]; ok {
+		config["host"] = host
+	}
+	if in.upper != nil {
+		config["upper"] = in.upper.GetLinkConfig(defaultAccessAddr, token)
+	}
+	return config
+}
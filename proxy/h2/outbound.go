@@ -0,0 +1,198 @@
+package h2
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"golang.org/x/net/http2"
+)
+
+// 会话空闲关闭时间与健康检查间隔
+const (
+	sessionIdleTimeout = 5 * time.Minute
+	sessionPingPeriod  = 30 * time.Second
+)
+
+type Outbound struct {
+	addr         string
+	name         string
+	upper        proxy.Outbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	scheme       string
+	path         string
+	host         string
+	transport    *http2.Transport
+	sessions     *proxy.SessionPool[*session]
+}
+
+// 会话池中的HTTP/2会话，记录下层连接地址供各条流使用
+type session struct {
+	*http2.ClientConn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (s *session) Closed() bool {
+	state := s.State()
+	return state.Closed || state.Closing
+}
+
+func (s *session) Idle() bool {
+	state := s.State()
+	return state.StreamsActive == 0 && !state.LastIdle.IsZero() && time.Since(state.LastIdle) > sessionIdleTimeout
+}
+
+func (out *Outbound) Scheme() string                 { return out.scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(schemeH2, H2OutboundCreator)
+	proxy.RegisterOutbound(schemeGrpc, H2OutboundCreator)
+}
+
+// HTTP/2出站代理实例的创建函数，同一出站代理实例的代理连接复用已建立的HTTP/2会话，各自作为一条流传输。
+// 一般作为tls出站代理的upper使用，scheme为grpc时按gRPC(Gun)格式封装数据
+func H2OutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	scheme, _ := config["scheme"].(string)
+	out := &Outbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+		scheme: scheme,
+		path:   streamPath(scheme, config),
+		host:   configString(config, "host", ""),
+		transport: &http2.Transport{
+			IdleConnTimeout: sessionIdleTimeout,
+			ReadIdleTimeout: sessionPingPeriod,
+		},
+		sessions: proxy.NewSessionPool[*session](sessionPingPeriod),
+	}
+	_, err := proxy.UpperOutboundCreate(out, config)
+	if err != nil {
+		return nil, err
+	}
+	proxy.RegisterMuxOutbound(name, out)
+	return out, nil
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	if out.upper != nil {
+		out.upper.UnregCloseChan(closeChan)
+	} else {
+		proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+	}
+}
+
+// 除关闭相关连接外，还需关闭所有HTTP/2会话
+func (out *Outbound) CloseAllConn() {
+	if out.upper != nil {
+		out.upper.CloseAllConn()
+	} else {
+		proxy.CloseAllConn(&out.closeChanSet)
+	}
+	out.sessions.CloseAll()
+}
+
+// 在与代理目标拨号地址相同的会话上打开新的流，没有可用会话时返回nil
+func (out *Outbound) OpenStream(target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	available, ok := out.sessions.Select(proxy.PoolKey(out.addr, target), func(sessions []*session) (*session, bool) {
+		for _, s := range sessions {
+			if s.CanTakeNewRequest() {
+				return s, true
+			}
+		}
+		return nil, false
+	})
+	if !ok {
+		return nil, nil, nil
+	}
+	return out.openStream(available, target)
+}
+
+func (out *Outbound) openStream(s *session, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	host := out.host
+	if host == "" {
+		if out.addr != "direct" {
+			host = out.addr
+		} else {
+			host = target.String()
+		}
+	}
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Scheme: "https", Host: host, Path: out.path},
+		Host:          host,
+		Header:        make(http.Header),
+		Body:          pr,
+		ContentLength: -1,
+	}
+	if out.scheme == schemeGrpc {
+		req.Header.Set("Content-Type", grpcContentType)
+		req.Header.Set("Te", "trailers")
+	}
+	resp, err := s.RoundTrip(req)
+	if err != nil {
+		pw.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: stream rejected with status %s", out.scheme, resp.Status)
+	}
+	stream := &streamConn{
+		reader: resp.Body,
+		writer: pw,
+		closeFunc: func() {
+			pw.Close()
+			resp.Body.Close()
+		},
+		grpc:   out.scheme == schemeGrpc,
+		local:  s.local,
+		remote: s.remote,
+	}
+
+	//处理上层叠加协议，返回包装后IO流
+	if out.upper != nil {
+		conn, closeChan, err := out.upper.WrapConn(stream, target)
+		if err != nil {
+			stream.Close()
+		}
+		return conn, closeChan, err
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return stream, closeChan, nil
+	}
+}
+
+// HTTP/2出站代理模块中的IO流包装器函数，在下层连接上建立新的HTTP/2会话并加入会话池，再打开首条流
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	cc, err := out.transport.NewClientConn(underlay)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &session{ClientConn: cc, local: underlay.LocalAddr(), remote: underlay.RemoteAddr()}
+	out.sessions.Add(proxy.PoolKey(out.addr, target), s)
+	return out.openStream(s, target)
+}
@@ -0,0 +1,239 @@
+package http
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// 响应写回后等待请求体转发完成的最长时间
+const requestBodyWait = time.Second
+
+// 逐跳请求头，只对客户端与代理之间的单个连接有效，不转发给代理目标
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"linkToken",
+}
+
+// 删除逐跳请求头及Connection中列出的请求头，协议升级请求保留Upgrade
+func removeHopByHopHeaders(header http.Header, upgrade string) {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if upgrade != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+	}
+}
+
+func isUpgrade(header http.Header) string {
+	for _, v := range header["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// 根据请求得到代理目标地址，补充缺省端口号
+func requestAddress(req *http.Request) string {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if req.URL.Scheme == "https" {
+			return net.JoinHostPort(host, "443")
+		}
+		return net.JoinHostPort(host, "80")
+	}
+	return host
+}
+
+// 普通HTTP请求(非CONNECT)的转发连接，客户端长连接上的每个请求作为一条子连接交由manager分别路由，
+// 因此同一连接上访问不同主机的请求会各自匹配出站代理。子连接按顺序处理，前一个请求的响应写回后才读取下一个请求
+type forwardConn struct {
+	net.Conn
+	in        *Inbound
+	reader    *bufio.Reader
+	userId    string
+	current   *requestConn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newForwardConn(in *Inbound, client net.Conn, userId string) *forwardConn {
+	return &forwardConn{
+		Conn:   client,
+		in:     in,
+		reader: bufio.NewReader(client),
+		userId: userId,
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *forwardConn) Accept() (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	if c.current != nil {
+		select {
+		case <-c.current.done:
+		case <-c.done:
+			return nil, nil, nil, io.EOF
+		}
+		if c.current.closeClient {
+			return nil, nil, nil, io.EOF
+		}
+	}
+	req, err := http.ReadRequest(c.reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if req.Method == http.MethodConnect {
+		fmt.Fprint(c.Conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, nil, nil, fmt.Errorf("http: CONNECT on forward proxy connection")
+	}
+	targetAddr, err := proxy.NewTargetAddr(requestAddress(req))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	targetAddr.UserId = c.userId
+	c.current = newRequestConn(c, req)
+	closeChan := make(chan struct{})
+	c.in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	return c.current, targetAddr, closeChan, nil
+}
+
+func (c *forwardConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Conn.Close()
+	})
+	return nil
+}
+
+// 单个HTTP请求的子连接。读方向为改写后的请求(origin-form，去除逐跳请求头和代理凭据)，
+// 写方向为代理目标返回的响应，解析后去除逐跳响应头写回客户端。
+// 请求以Connection: close发往代理目标，每个请求独立建立出站连接
+type requestConn struct {
+	net.Conn
+	reqReader   *io.PipeReader
+	respWriter  *io.PipeWriter
+	respDone    chan struct{}
+	done        chan struct{}
+	closeClient bool //响应完成后需要关闭客户端连接
+	closeOnce   sync.Once
+}
+
+func newRequestConn(fc *forwardConn, req *http.Request) *requestConn {
+	reqReader, reqWriter := io.Pipe()
+	respReader, respWriter := io.Pipe()
+	c := &requestConn{
+		Conn:       fc.Conn,
+		reqReader:  reqReader,
+		respWriter: respWriter,
+		respDone:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	upgrade := isUpgrade(req.Header)
+	clientClose := req.Close
+	removeHopByHopHeaders(req.Header, upgrade)
+	req.Close = upgrade == ""
+	req.RequestURI = ""
+
+	//请求方向，req.Write按origin-form写出请求行，并按原有编码方式转发请求体
+	reqErr := make(chan error, 1)
+	go func() {
+		err := req.Write(reqWriter)
+		if err == nil && upgrade != "" {
+			//协议升级后为双向透明传输，继续转发客户端后续数据
+			_, err = io.Copy(reqWriter, fc.reader)
+		}
+		reqWriter.CloseWithError(err)
+		reqErr <- err
+	}()
+
+	//响应方向
+	go func() {
+		defer close(c.respDone)
+		defer respReader.Close()
+		br := bufio.NewReader(respReader)
+		for {
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				c.closeClient = true
+				fmt.Fprint(fc.Conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+				return
+			}
+			if resp.StatusCode == http.StatusSwitchingProtocols && upgrade != "" {
+				removeHopByHopHeaders(resp.Header, resp.Header.Get("Upgrade"))
+				resp.Write(fc.Conn)
+				io.Copy(fc.Conn, br)
+				c.closeClient = true
+				return
+			}
+			//1xx临时响应直接写回，继续读取最终响应
+			if resp.StatusCode >= 100 && resp.StatusCode < 200 {
+				resp.Write(fc.Conn)
+				continue
+			}
+			removeHopByHopHeaders(resp.Header, "")
+			//响应体以连接关闭为结束标志时，写回客户端后同样需要关闭连接
+			resp.Close = clientClose || resp.ContentLength < 0 && len(resp.TransferEncoding) == 0
+			err = resp.Write(fc.Conn)
+			resp.Body.Close()
+			c.closeClient = resp.Close || err != nil
+			//请求体未完整转发时，客户端连接中的后续数据无法再解析为请求
+			select {
+			case err := <-reqErr:
+				c.closeClient = c.closeClient || err != nil
+			case <-time.After(requestBodyWait):
+				c.closeClient = true
+			}
+			return
+		}
+	}()
+	return c
+}
+
+func (c *requestConn) Read(b []byte) (int, error) {
+	return c.reqReader.Read(b)
+}
+
+// 响应写回完成后返回错误，使转发协程及时结束，不必等待代理目标关闭连接
+func (c *requestConn) Write(b []byte) (int, error) {
+	return c.respWriter.Write(b)
+}
+
+// 关闭子连接，不关闭客户端连接。代理目标未返回完整响应时，由响应方向应答502
+func (c *requestConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.reqReader.Close()
+		c.respWriter.Close()
+		<-c.respDone
+		close(c.done)
+	})
+	return nil
+}
@@ -1,3 +1,28 @@
 package http
 
+import (
+	"encoding/base64"
+	"strings"
+)
+
 const scheme = "http"
+
+// 解析Proxy-Authorization请求头中的Basic凭据。
+// Digest方式需要服务端持有明文密码或MD5(用户名:realm:密码)，而用户库中只保存了密码的SHA256摘要，因此不支持
+func parseProxyAuthorization(header map[string]string) (username, password string, ok bool) {
+	for k, v := range header {
+		if !strings.EqualFold(k, "Proxy-Authorization") {
+			continue
+		}
+		authScheme, credentials, found := strings.Cut(v, " ")
+		if !found || !strings.EqualFold(authScheme, "Basic") {
+			return "", "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+		if err != nil {
+			return "", "", false
+		}
+		return strings.Cut(string(decoded), ":")
+	}
+	return "", "", false
+}
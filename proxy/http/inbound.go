@@ -19,6 +19,7 @@ type Inbound struct {
 	upper        proxy.Inbound
 	config       map[string]interface{}
 	closeChanSet sync.Map
+	allowGuest   bool
 }
 
 func (in *Inbound) Scheme() string                 { return scheme }
@@ -41,6 +42,8 @@ func init() {
 	proxy.RegisterInbound(scheme, HttpInboundCreator)
 	proxy.RegisterInbound("https", HttpInboundCreator)
 }
+
+// HTTP入站代理实例的创建函数，未配置guestForward时默认对未认证的客户端应答407，要求浏览器等客户端提供用户名密码，allowGuest为true时按guest用户处理
 func HttpInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
 	addr, ok := config["address"].(string)
 	if !ok {
@@ -51,6 +54,9 @@ func HttpInboundCreator(name string, config map[string]interface{}) (proxy.Inbou
 		name:   name,
 		config: config,
 	}
+	if v, ok := config["allowGuest"].(bool); ok {
+		in.allowGuest = v
+	}
 	_, err := proxy.UpperInboundCreate(in, config)
 
 	return in, err
@@ -99,8 +105,16 @@ func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string)
 		header["linkToken"] = strings.Trim(URL, "/ ")
 	}
 
+	//只将凭据交给认证回调函数，其余请求头由客户端任意填写
+	info := map[string]string{"linkToken": header["linkToken"]}
+	//标准代理认证头，Basic方式携带用户名和密码
+	if username, password, ok := parseProxyAuthorization(header); ok {
+		info["username"] = username
+		info["password"] = password
+	}
+
 	//结合用户认证模块进行认证
-	userId := authFunc(header)
+	userId := authFunc(info)
 
 	//实现端口防探测保护，开启后可，如果没有代理认证凭证，则将流量转发到guestForward对应地址，该地址一般对应非代理服务
 	forward := in.config["guestForward"]
@@ -120,6 +134,22 @@ func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string)
 		return nil, nil, nil, fmt.Errorf("auth fail")
 	}
 
+	//未配置guestForward且不允许游客连接时，质询客户端提供凭据
+	if forward == nil && userId == "guest" && !in.allowGuest {
+		fmt.Fprint(wrappedConn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"ZIProxy\"\r\n"+
+			"Content-Length: 0\r\n"+
+			"Connection: close\r\n\r\n")
+		return nil, nil, nil, fmt.Errorf("proxy authentication required")
+	}
+
+	//普通HTTP请求逐个解析、改写后转发，每个请求单独路由
+	if method != "CONNECT" && in.upper == nil {
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return newForwardConn(in, wrappedConn, userId), nil, closeChan, nil
+	}
+
 	if method == "CONNECT" {
 		address = URL
 	} else {
@@ -1,6 +1,7 @@
 package http
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
 	"strings"
@@ -62,6 +63,12 @@ func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.
 		token := out.config["linkToken"].(string)
 		authHead = fmt.Sprintf("linkToken:%s\r\n", token)
 	}
+	//上级为标准HTTP代理时，使用Basic方式发送用户名密码
+	if username, ok := out.config["username"].(string); ok {
+		password, _ := out.config["password"].(string)
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		authHead += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
 	//生成HTTP CONNECT请求头，携带代理凭证属性
 	_, err := fmt.Fprintf(underlay, "CONNECT %s HTTP/1.1\r\n"+
 		"%s"+
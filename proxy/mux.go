@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// 多路复用连接，一个下层连接中承载多条子连接。
+// 入站代理WrapConn返回的连接如果实现了该接口，manager将逐一接收其中的子连接并分别建立流量通道，
+// Accept的返回值与Inbound.WrapConn相同，即已经过多路复用层之上的协议处理。
+type MuxConn interface {
+	net.Conn
+	Accept() (net.Conn, *TargetAddr, chan struct{}, error)
+}
+
+// 多路复用出站代理层实现该接口，可在已建立的会话上直接打开子连接，跳过拨号和下层协议握手。
+// 没有可用会话时返回nil连接，manager按正常流程拨号并调用WrapConn，下层连接此后由新建的会话持有。
+type MuxOutbound interface {
+	OpenStream(target *TargetAddr) (net.Conn, chan struct{}, error)
+}
+
+var (
+	muxOutboundMap sync.Map //出站代理实例名称 -> 出站代理链中的多路复用层
+)
+
+// 多路复用层创建时以所属出站代理实例名称注册
+func RegisterMuxOutbound(name string, m MuxOutbound) {
+	muxOutboundMap.Store(name, m)
+}
+
+// 出站代理实例删除或重建时取消注册
+func UnregisterMuxOutbound(name string) {
+	muxOutboundMap.Delete(name)
+}
+
+func LoadMuxOutbound(name string) (MuxOutbound, bool) {
+	if m, ok := muxOutboundMap.Load(name); ok {
+		return m.(MuxOutbound), true
+	}
+	return nil, false
+}
+
+// 会话池中的会话
+type PoolSession interface {
+	Closed() bool //会话已关闭或正在关闭
+	Idle() bool   //会话没有子连接且空闲超时，清理时关闭
+	Close() error
+}
+
+// SessionPool 多路复用出站代理层的会话池，会话按下层连接的拨号地址分组，只被拨号地址相同的代理连接复用。
+// 池中有会话时由后台协程定期清理已关闭和空闲的会话，会话全部清理后协程退出
+type SessionPool[S PoolSession] struct {
+	period   time.Duration
+	mu       sync.Mutex
+	sessions map[string][]S
+	reaping  bool
+}
+
+func NewSessionPool[S PoolSession](period time.Duration) *SessionPool[S] {
+	return &SessionPool[S]{period: period, sessions: make(map[string][]S)}
+}
+
+// PoolKey 返回代理连接所属的会话分组。出站代理链的基础地址为direct时下层连接直接拨号代理目标，按目标分组；否则共用一组
+func PoolKey(addr string, target *TargetAddr) string {
+	if addr == "direct" {
+		return target.String()
+	}
+	return ""
+}
+
+// 清理分组中已关闭和空闲的会话，调用时需持有锁
+func (p *SessionPool[S]) prune(key string) []S {
+	alive := p.sessions[key][:0]
+	for _, s := range p.sessions[key] {
+		if s.Closed() {
+			continue
+		}
+		if s.Idle() {
+			s.Close()
+			continue
+		}
+		alive = append(alive, s)
+	}
+	if len(alive) == 0 {
+		delete(p.sessions, key)
+	} else {
+		p.sessions[key] = alive
+	}
+	return alive
+}
+
+// Select 清理分组后由choose从剩余会话中选择可用的会话
+func (p *SessionPool[S]) Select(key string, choose func(sessions []S) (S, bool)) (S, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return choose(p.prune(key))
+}
+
+// Add 将新建的会话加入分组，并在需要时启动清理协程
+func (p *SessionPool[S]) Add(key string, s S) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[key] = append(p.sessions[key], s)
+	if !p.reaping {
+		p.reaping = true
+		go p.reap()
+	}
+}
+
+func (p *SessionPool[S]) reap() {
+	ticker := time.NewTicker(p.period)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		for key := range p.sessions {
+			p.prune(key)
+		}
+		if len(p.sessions) == 0 {
+			p.reaping = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// CloseAll 关闭并移除所有会话
+func (p *SessionPool[S]) CloseAll() {
+	p.mu.Lock()
+	sessions := p.sessions
+	p.sessions = make(map[string][]S)
+	p.mu.Unlock()
+	for _, group := range sessions {
+		for _, s := range group {
+			s.Close()
+		}
+	}
+}
+
+type acceptedConn struct {
+	conn      net.Conn
+	target    *TargetAddr
+	closeChan chan struct{}
+}
+
+// MuxConn的通用实现，多路复用层在各子连接的处理协程中完成上层协议处理后调用Push，manager通过Accept取出
+type StreamAcceptor struct {
+	net.Conn
+	accepted  chan acceptedConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewStreamAcceptor(underlay net.Conn) *StreamAcceptor {
+	return &StreamAcceptor{
+		Conn:     underlay,
+		accepted: make(chan acceptedConn),
+		done:     make(chan struct{}),
+	}
+}
+
+// Push 提交一条已处理的子连接，会话已关闭时返回false
+func (a *StreamAcceptor) Push(conn net.Conn, target *TargetAddr, closeChan chan struct{}) bool {
+	select {
+	case a.accepted <- acceptedConn{conn, target, closeChan}:
+		return true
+	case <-a.done:
+		return false
+	}
+}
+
+func (a *StreamAcceptor) Accept() (net.Conn, *TargetAddr, chan struct{}, error) {
+	select {
+	case c := <-a.accepted:
+		return c.conn, c.target, c.closeChan, nil
+	case <-a.done:
+		return nil, nil, nil, io.EOF
+	}
+}
+
+// Done 返回会话结束的消息通道
+func (a *StreamAcceptor) Done() chan struct{} {
+	return a.done
+}
+
+func (a *StreamAcceptor) Close() error {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		a.Conn.Close()
+	})
+	return nil
+}
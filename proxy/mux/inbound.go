@@ -0,0 +1,124 @@
+package mux
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/hashicorp/yamux"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	upper        proxy.Inbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+}
+
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, MuxInboundCreator)
+}
+
+// 多路复用入站代理实例的创建函数，下层连接中的每条子连接作为一条代理连接交由上层协议处理
+func MuxInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	in := &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+	}
+	_, err := proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+// 会话的关闭消息通道始终注册在本层，各条子连接的关闭消息通道按上层叠加协议处理
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+	if in.upper != nil {
+		in.upper.UnregCloseChan(closeChan)
+	}
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+	if in.upper != nil {
+		in.upper.CloseAllConn()
+	}
+}
+
+// 处理单条子连接，完成上层协议处理后提交给manager
+func (in *Inbound) serveStream(acceptor *proxy.StreamAcceptor, stream net.Conn, authFunc func(map[string]string) string) {
+	var conn net.Conn = stream
+	var target *proxy.TargetAddr
+	var closeChan chan struct{}
+	if in.upper != nil {
+		var err error
+		conn, target, closeChan, err = in.upper.WrapConn(stream, authFunc)
+		if err != nil {
+			log.Printf("inbound %s recieve stream from %s fail", in.name, stream.RemoteAddr())
+			stream.Close()
+			return
+		}
+	} else {
+		closeChan = make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	}
+	if !acceptor.Push(conn, target, closeChan) {
+		in.UnregCloseChan(closeChan)
+		stream.Close()
+	}
+}
+
+// 多路复用入站代理模块中的IO流包装器函数，在下层连接上建立会话，返回可逐一接收各条子连接的多路复用连接
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	ys, err := yamux.Server(underlay, sessionConfig())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	acceptor := proxy.NewStreamAcceptor(underlay)
+	go func() {
+		defer acceptor.Close()
+		defer ys.Close()
+		for {
+			stream, err := ys.Accept()
+			if err != nil {
+				return
+			}
+			go in.serveStream(acceptor, stream, authFunc)
+		}
+	}()
+	closeChan := make(chan struct{})
+	in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	return acceptor, nil, closeChan, nil
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	config := make(map[string]interface{})
+	config["scheme"] = scheme
+	config["address"] = proxy.GetLinkAddr(in, defaultAccessAddr)
+	if in.upper != nil {
+		config["upper"] = in.upper.GetLinkConfig(defaultAccessAddr, token)
+	}
+	return config
+}
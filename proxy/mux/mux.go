@@ -0,0 +1,30 @@
+package mux
+
+import (
+	"io"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+const scheme = "mux"
+
+const (
+	defaultMaxStreams  = 16              //单个会话默认最大并发子连接数
+	sessionIdleTimeout = 5 * time.Minute //会话无子连接时的保留时间
+	sessionReapPeriod  = time.Minute     //会话池清理间隔
+)
+
+func configInt(config map[string]interface{}, key string, def int) int {
+	if v, ok := config[key].(float64); ok && v > 0 {
+		return int(v)
+	}
+	return def
+}
+
+// 多路复用会话配置，子连接数量由出站代理控制，此处只需关闭yamux自带的日志输出
+func sessionConfig() *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = io.Discard
+	return config
+}
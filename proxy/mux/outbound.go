@@ -0,0 +1,142 @@
+package mux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/hashicorp/yamux"
+)
+
+type Outbound struct {
+	addr         string
+	name         string
+	upper        proxy.Outbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	maxStreams   int
+	sessions     *proxy.SessionPool[*session]
+}
+
+// 会话池中的多路复用会话
+type session struct {
+	*yamux.Session
+	lastActive time.Time //最近一次打开子连接的时间，由会话池的锁保护
+}
+
+func (s *session) Closed() bool {
+	return s.IsClosed()
+}
+
+func (s *session) Idle() bool {
+	return s.NumStreams() == 0 && time.Since(s.lastActive) > sessionIdleTimeout
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, MuxOutboundCreator)
+}
+
+// 多路复用出站代理实例的创建函数，可叠加在任意出站代理链中。
+// 同一出站代理实例的代理连接复用已建立的下层连接，各自作为一条子连接传输，maxStreams为单个会话的最大并发子连接数
+func MuxOutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	out := &Outbound{
+		addr:       addr,
+		name:       name,
+		config:     config,
+		maxStreams: configInt(config, "maxStreams", defaultMaxStreams),
+		sessions:   proxy.NewSessionPool[*session](sessionReapPeriod),
+	}
+	_, err := proxy.UpperOutboundCreate(out, config)
+	if err != nil {
+		return nil, err
+	}
+	proxy.RegisterMuxOutbound(name, out)
+	return out, nil
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	if out.upper != nil {
+		out.upper.UnregCloseChan(closeChan)
+	} else {
+		proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+	}
+}
+
+// 除关闭相关连接外，还需关闭会话池中所有会话
+func (out *Outbound) CloseAllConn() {
+	if out.upper != nil {
+		out.upper.CloseAllConn()
+	} else {
+		proxy.CloseAllConn(&out.closeChanSet)
+	}
+	out.sessions.CloseAll()
+}
+
+// 在与代理目标拨号地址相同的会话中选择子连接数最少且未满的会话打开子连接，没有可用会话时返回nil
+func (out *Outbound) OpenStream(target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	available, ok := out.sessions.Select(proxy.PoolKey(out.addr, target), func(sessions []*session) (*session, bool) {
+		var available *session
+		for _, s := range sessions {
+			streams := s.NumStreams()
+			if streams < out.maxStreams && (available == nil || streams < available.NumStreams()) {
+				available = s
+			}
+		}
+		if available == nil {
+			return nil, false
+		}
+		available.lastActive = time.Now()
+		return available, true
+	})
+	if !ok {
+		return nil, nil, nil
+	}
+	return out.openStream(available, target)
+}
+
+func (out *Outbound) openStream(s *session, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	stream, err := s.OpenStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	//处理上层叠加协议，返回包装后IO流
+	if out.upper != nil {
+		conn, closeChan, err := out.upper.WrapConn(stream, target)
+		if err != nil {
+			stream.Close()
+		}
+		return conn, closeChan, err
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return stream, closeChan, nil
+	}
+}
+
+// 多路复用出站代理模块中的IO流包装器函数，在下层连接上建立新的会话并加入会话池，再打开首条子连接
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	ys, err := yamux.Client(underlay, sessionConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &session{Session: ys, lastActive: time.Now()}
+	out.sessions.Add(proxy.PoolKey(out.addr, target), s)
+	return out.openStream(s, target)
+}
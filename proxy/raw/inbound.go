@@ -56,10 +56,22 @@ func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
 func (in *Inbound) CloseAllConn() {
 	proxy.CloseAllConn(&in.closeChanSet)
 }
+
+// raw入站不解析协议，连接目标为配置的target，未配置时为连接的本地地址(如iptables DNAT后的地址)，连接不携带凭据，按guest处理
 func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	target, _ := in.config["target"].(string)
+	if target == "" {
+		target = underlay.LocalAddr().String()
+	}
+	targetAddr, err := proxy.NewTargetAddr(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	targetAddr.UserId = authFunc(map[string]string{})
+
 	closeChan := make(chan struct{})
 	in.closeChanSet.LoadOrStore(closeChan, struct{}{})
-	return underlay, nil, closeChan, nil
+	return underlay, targetAddr, closeChan, nil
 }
 
 func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
@@ -0,0 +1,119 @@
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	scheme       string
+	sourceUsers  []sourceUser
+}
+
+func (in *Inbound) Scheme() string                 { return in.scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+
+// 透明代理直接从下层连接获取代理目标，不支持上层叠加协议
+func (in *Inbound) SetUpper(upper proxy.Inbound) {}
+
+func init() {
+	proxy.RegisterInbound(schemeRedirect, RedirectInboundCreator)
+	proxy.RegisterInbound(schemeTproxy, RedirectInboundCreator)
+}
+
+// 透明代理入站代理实例的创建函数，仅支持Linux。
+// redirect接收iptables REDIRECT转发的连接，tproxy接收TPROXY转发的连接；sourceUsers将来源网段映射到用户
+func RedirectInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	if !supported {
+		return nil, errUnsupported
+	}
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	sourceUsers, err := parseSourceUsers(config)
+	if err != nil {
+		return nil, err
+	}
+	scheme, _ := config["scheme"].(string)
+	in := &Inbound{
+		addr:        addr,
+		name:        name,
+		config:      config,
+		scheme:      scheme,
+		sourceUsers: sourceUsers,
+	}
+	return in, nil
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+}
+
+// tproxy的监听套接字需要设置IP_TRANSPARENT
+func (in *Inbound) ListenConfig() *net.ListenConfig {
+	if in.scheme == schemeTproxy {
+		return &net.ListenConfig{Control: setTransparent}
+	}
+	return &net.ListenConfig{}
+}
+
+// 透明代理模块中恢复原始目标地址的IO流包装器函数，连接内容不做任何处理
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	var dst *net.TCPAddr
+	if in.scheme == schemeTproxy {
+		//TPROXY不修改目标地址，连接的本地地址即为原始目标
+		dst, _ = underlay.LocalAddr().(*net.TCPAddr)
+		if dst == nil {
+			return nil, nil, nil, fmt.Errorf("tproxy: underlay is not a tcp connection")
+		}
+	} else {
+		var err error
+		dst, err = originalDst(underlay)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	targetAddr, err := proxy.NewTargetAddr(dst.String())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//连接不携带凭据，按来源网段确定用户，未匹配或用户未启用时为guest
+	if userId := matchSourceUser(in.sourceUsers, underlay.RemoteAddr()); userId != "" && proxy.UserEnabled(userId) {
+		targetAddr.UserId = userId
+	} else {
+		targetAddr.UserId = authFunc(map[string]string{})
+	}
+
+	closeChan := make(chan struct{})
+	in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+	return underlay, targetAddr, closeChan, nil
+}
+
+// 透明代理无需客户端配置，只返回协议和监听地址
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	config := make(map[string]interface{})
+	config["scheme"] = in.scheme
+	config["address"] = proxy.GetLinkAddr(in, defaultAccessAddr)
+	return config
+}
@@ -0,0 +1,57 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+const (
+	schemeRedirect = "redirect"
+	schemeTproxy   = "tproxy"
+)
+
+var errUnsupported = errors.New("transparent proxy is only supported on linux")
+
+// 来源网段到用户的映射，透明代理的流量不携带凭据，据此确定连接所属用户
+type sourceUser struct {
+	network *net.IPNet
+	userId  string
+}
+
+// 解析配置中的sourceUsers，网段前缀越长优先级越高
+func parseSourceUsers(config map[string]interface{}) ([]sourceUser, error) {
+	m, _ := config["sourceUsers"].(map[string]interface{})
+	var users []sourceUser
+	for cidr, v := range m {
+		userId, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("sourceUsers %s: user id is not string", cidr)
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, sourceUser{network: network, userId: userId})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		li, _ := users[i].network.Mask.Size()
+		lj, _ := users[j].network.Mask.Size()
+		return li > lj
+	})
+	return users, nil
+}
+
+func matchSourceUser(users []sourceUser, addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	for _, u := range users {
+		if u.network.Contains(tcpAddr.IP) {
+			return u.userId
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package redirect
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	supported     = true
+	soOriginalDst = 80 //SO_ORIGINAL_DST与IP6T_SO_ORIGINAL_DST取值相同
+)
+
+// 通过getsockopt(SO_ORIGINAL_DST)获取iptables REDIRECT之前的目标地址
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("redirect: underlay is not a tcp connection")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	isIPv6 := local != nil && local.IP.To4() == nil
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		//内核返回sockaddr结构，借用大小合适的getsockopt函数读取，端口为网络字节序
+		if isIPv6 {
+			info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(port[0])<<8 | int(port[1])}
+		} else {
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(sa[2])<<8 | int(sa[3])}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return addr, sockErr
+}
+
+// 为监听套接字设置IP_TRANSPARENT，使其可以接收TPROXY转发的非本机地址连接，需要CAP_NET_ADMIN权限
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			//双栈套接字同时尝试设置IPv4选项
+			unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package redirect
+
+import (
+	"net"
+	"syscall"
+)
+
+const supported = false
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errUnsupported
+}
+
+func setTransparent(network, address string, c syscall.RawConn) error {
+	return errUnsupported
+}
@@ -0,0 +1,156 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Shadowsocks AEAD加密IO流，数据由[加密长度块][加密负载块]序列组成。
+// 客户端侧创建时即已确定写方向密钥，读方向在首次读时根据服务端盐值派生；服务端侧相反。
+type Conn struct {
+	net.Conn
+	spec       *cipherSpec
+	key        []byte
+	reader     cipher.AEAD
+	readNonce  []byte
+	readBuf    []byte
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeMu    sync.Mutex
+	//请求方向的盐值，SIP022响应头需要携带该值供客户端校验
+	requestSalt []byte
+}
+
+func (c *Conn) openChunk(n int) ([]byte, error) {
+	buf := make([]byte, n+tagSize)
+	if _, err := io.ReadFull(c.Conn, buf); err != nil {
+		return nil, err
+	}
+	b, err := c.reader.Open(buf[:0], c.readNonce, buf, nil)
+	increment(c.readNonce)
+	return b, err
+}
+
+func (c *Conn) sealChunk(dst, b []byte) []byte {
+	dst = c.writer.Seal(dst, c.writeNonce, b, nil)
+	increment(c.writeNonce)
+	return dst
+}
+
+// 追加一组长度块和负载块
+func (c *Conn) sealPayload(dst, b []byte) []byte {
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(b)))
+	dst = c.sealChunk(dst, size[:])
+	return c.sealChunk(dst, b)
+}
+
+// 客户端首次读时处理服务端响应：读取盐值派生子密钥，SIP022还需校验响应头中的类型、时间戳和请求盐值
+func (c *Conn) readResponseHeader() error {
+	salt := make([]byte, c.spec.keySize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	aead, err := c.spec.sessionAEAD(c.key, salt)
+	if err != nil {
+		return err
+	}
+	c.reader = aead
+	c.readNonce = make([]byte, aead.NonceSize())
+	if !c.spec.is2022 {
+		return nil
+	}
+	header, err := c.openChunk(1 + 8 + c.spec.keySize + 2)
+	if err != nil {
+		return err
+	}
+	if header[0] != headerTypeServer {
+		return errBadHeader
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(header[1:9])); err != nil {
+		return err
+	}
+	if string(header[9:9+c.spec.keySize]) != string(c.requestSalt) {
+		return errBadHeader
+	}
+	size := int(binary.BigEndian.Uint16(header[9+c.spec.keySize:]))
+	c.readBuf, err = c.openChunk(size)
+	return err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		if err := c.readResponseHeader(); err != nil {
+			return 0, err
+		}
+	}
+	for len(c.readBuf) == 0 {
+		size, err := c.openChunk(2)
+		if err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(size))
+		if n > c.spec.maxPayload() {
+			return 0, errors.New("shadowsocks: chunk too large")
+		}
+		c.readBuf, err = c.openChunk(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var out []byte
+	rest := b
+	if c.writer == nil {
+		//服务端首次写：发送盐值，SIP022还需发送携带请求盐值和首个负载块长度的响应头
+		salt := make([]byte, c.spec.keySize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.spec.sessionAEAD(c.key, salt)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = aead
+		c.writeNonce = make([]byte, aead.NonceSize())
+		out = append(out, salt...)
+		if c.spec.is2022 {
+			first := rest
+			if len(first) > c.spec.maxPayload() {
+				first = first[:c.spec.maxPayload()]
+			}
+			header := []byte{headerTypeServer}
+			header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+			header = append(header, c.requestSalt...)
+			header = binary.BigEndian.AppendUint16(header, uint16(len(first)))
+			out = c.sealChunk(out, header)
+			out = c.sealChunk(out, first)
+			rest = rest[len(first):]
+		}
+	}
+	for len(rest) > 0 {
+		chunk := rest
+		if len(chunk) > c.spec.maxPayload() {
+			chunk = chunk[:c.spec.maxPayload()]
+		}
+		out = c.sealPayload(out, chunk)
+		rest = rest[len(chunk):]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
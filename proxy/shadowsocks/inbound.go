@@ -0,0 +1,282 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/socks5"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	upper        proxy.Inbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	spec         *cipherSpec
+	sharedKey    []byte
+	keys         *proxy.TokenTable[*keyTable]
+	salts        *saltPool
+}
+
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, ShadowsocksInboundCreator)
+}
+
+// Shadowsocks入站代理实例的创建函数，每个用户以各自linkToken派生的密钥连接，可选的password为游客共享密钥
+func ShadowsocksInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	spec, err := getCipherSpec(config)
+	if err != nil {
+		return nil, err
+	}
+	in := &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+		spec:   spec,
+		salts:  newSaltPool(),
+	}
+	in.keys = proxy.NewTokenTable(in.buildKeyTable)
+	if password, ok := config["password"].(string); ok && password != "" {
+		in.sharedKey, err = spec.keyFromPassword(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+}
+
+// 用户密钥表，在用户同步后重建
+type keyTable struct {
+	users      []userKey
+	identities map[[aes.BlockSize]byte]userKey //用户密钥的blake3摘要前16字节 -> 用户，用于SIP022身份头查找
+}
+
+type userKey struct {
+	token string
+	key   []byte
+}
+
+func (in *Inbound) buildKeyTable(tokens []string) *keyTable {
+	t := &keyTable{identities: make(map[[aes.BlockSize]byte]userKey)}
+	for _, token := range tokens {
+		key, err := in.spec.keyFromPassword(in.spec.passwordFromToken(token))
+		if err != nil {
+			continue
+		}
+		u := userKey{token, key}
+		t.users = append(t.users, u)
+		if in.spec.is2022 {
+			t.identities[identityHash(key)] = u
+		}
+	}
+	return t
+}
+
+// 服务端配置了共享密钥且加密方式支持时，SIP022客户端在请求中携带身份头，服务端据此直接确定用户
+func (in *Inbound) identityEnabled() bool {
+	return in.sharedKey != nil && in.spec.supportsIdentity()
+}
+
+// 尝试使用密钥解密首个加密块
+func (in *Inbound) tryKey(key, salt, chunk []byte) (*Conn, []byte) {
+	aead, err := in.spec.sessionAEAD(key, salt)
+	if err != nil {
+		return nil, nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plain, err := aead.Open(nil, nonce, chunk, nil)
+	if err != nil {
+		return nil, nil
+	}
+	increment(nonce)
+	return &Conn{spec: in.spec, key: key, reader: aead, readNonce: nonce}, plain
+}
+
+// 依次使用共享密钥和各用户密钥尝试解密首个加密块，解密成功的密钥即确定了连接所属用户
+func (in *Inbound) identify(salt, chunk []byte, authFunc func(map[string]string) string) (*Conn, []byte, string, error) {
+	if in.sharedKey != nil {
+		if c, plain := in.tryKey(in.sharedKey, salt, chunk); c != nil {
+			return c, plain, authFunc(map[string]string{}), nil
+		}
+	}
+	for _, u := range in.keys.Load().users {
+		if c, plain := in.tryKey(u.key, salt, chunk); c != nil {
+			return c, plain, authFunc(map[string]string{"linkToken": u.token}), nil
+		}
+	}
+	return nil, nil, "", fmt.Errorf("shadowsocks: no matching key")
+}
+
+// SIP022身份头：以共享密钥和盐值派生的子密钥解密请求的前16字节，得到用户密钥摘要后查表确定用户，
+// 无需逐一尝试用户密钥。不是已知用户时按不携带身份头、直接使用共享密钥的游客连接处理
+func (in *Inbound) identifyByHeader(underlay io.Reader, salt, chunk []byte, authFunc func(map[string]string) string) (*Conn, []byte, string, error) {
+	block, err := aes.NewCipher(in.spec.identitySubkey(in.sharedKey, salt))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	var id [aes.BlockSize]byte
+	block.Decrypt(id[:], chunk[:aes.BlockSize])
+	if u, ok := in.keys.Load().identities[id]; ok {
+		//身份头之后才是首个加密块，补齐被身份头占用的长度
+		header := make([]byte, len(chunk))
+		copy(header, chunk[aes.BlockSize:])
+		if _, err := io.ReadFull(underlay, header[len(chunk)-aes.BlockSize:]); err != nil {
+			return nil, nil, "", err
+		}
+		if c, plain := in.tryKey(u.key, salt, header); c != nil {
+			return c, plain, authFunc(map[string]string{"linkToken": u.token}), nil
+		}
+		return nil, nil, "", errBadHeader
+	}
+	if c, plain := in.tryKey(in.sharedKey, salt, chunk); c != nil {
+		return c, plain, authFunc(map[string]string{}), nil
+	}
+	return nil, nil, "", fmt.Errorf("shadowsocks: no matching key")
+}
+
+// Shadowsocks入站代理模块中实现用户识别、请求头解析、加密解密的IO流包装器函数
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	salt := make([]byte, in.spec.keySize)
+	if _, err := io.ReadFull(underlay, salt); err != nil {
+		return nil, nil, nil, err
+	}
+	//首个加密块：经典AEAD为长度块，SIP022为定长请求头
+	headerSize := 2
+	if in.spec.is2022 {
+		headerSize = 1 + 8 + 2
+	}
+	chunk := make([]byte, headerSize+tagSize)
+	if _, err := io.ReadFull(underlay, chunk); err != nil {
+		return nil, nil, nil, err
+	}
+	var conn *Conn
+	var header []byte
+	var userId string
+	var err error
+	if in.identityEnabled() {
+		conn, header, userId, err = in.identifyByHeader(underlay, salt, chunk, authFunc)
+	} else {
+		conn, header, userId, err = in.identify(salt, chunk, authFunc)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !in.salts.check(salt) {
+		return nil, nil, nil, errReplay
+	}
+	conn.Conn = underlay
+	conn.requestSalt = salt
+
+	var size int
+	if in.spec.is2022 {
+		if header[0] != headerTypeClient {
+			return nil, nil, nil, errBadHeader
+		}
+		if err := checkTimestamp(binary.BigEndian.Uint64(header[1:9])); err != nil {
+			return nil, nil, nil, err
+		}
+		size = int(binary.BigEndian.Uint16(header[9:]))
+	} else {
+		size = int(binary.BigEndian.Uint16(header))
+	}
+	payload, err := conn.openChunk(size)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//负载以SOCKS5地址格式的代理目标开头，SIP022在其后还有填充，剩余部分为首段代理数据
+	r := bytes.NewReader(payload)
+	targetAddr, err := socks5.ReadAddr(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if in.spec.is2022 {
+		var paddingLen uint16
+		if err := binary.Read(r, binary.BigEndian, &paddingLen); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, err := r.Seek(int64(paddingLen), io.SeekCurrent); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	conn.readBuf = payload[len(payload)-r.Len():]
+	targetAddr.UserId = userId
+
+	//处理上层叠加协议
+	if in.upper != nil {
+		innerConn, subTarget, closeChan, err := in.upper.WrapConn(conn, authFunc)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if subTarget != nil {
+			targetAddr.Custom = subTarget.Custom
+		}
+		return innerConn, targetAddr, closeChan, err
+	} else {
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return conn, targetAddr, closeChan, nil
+	}
+}
+
+// 生成客户端配置及SIP002格式的ss://链接
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	addr := proxy.GetLinkAddr(in, defaultAccessAddr)
+	password := in.spec.passwordFromToken(token)
+	if token == "" {
+		password, _ = in.config["password"].(string)
+	} else if in.identityEnabled() {
+		//携带身份头的客户端密码格式为 共享密钥:用户密钥
+		password = in.config["password"].(string) + ":" + password
+	}
+	var userInfo string
+	if in.spec.is2022 {
+		userInfo = url.UserPassword(in.spec.method, password).String()
+	} else {
+		userInfo = base64.RawURLEncoding.EncodeToString([]byte(in.spec.method + ":" + password))
+	}
+	config := map[string]interface{}{
+		"scheme":   scheme,
+		"address":  addr,
+		"method":   in.spec.method,
+		"password": password,
+		"url":      "ss://" + userInfo + "@" + addr + "#" + url.PathEscape(in.name),
+	}
+	return config
+}
@@ -0,0 +1,148 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/socks5"
+	"github.com/ZIXT233/ziproxy/utils"
+)
+
+type Outbound struct {
+	addr         string
+	name         string
+	upper        proxy.Outbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	spec         *cipherSpec
+	key          []byte
+	identityKeys [][]byte //SIP022身份头使用的各级身份密钥
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, ShadowsocksOutboundCreator)
+}
+
+func ShadowsocksOutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	spec, err := getCipherSpec(config)
+	if err != nil {
+		return nil, err
+	}
+	password, ok := config["password"].(string)
+	if !ok {
+		return nil, fmt.Errorf("password is required")
+	}
+	//SIP022多用户服务端的密码格式为 身份密钥:用户密钥，请求中携带身份头
+	var keys [][]byte
+	passwords := []string{password}
+	if spec.supportsIdentity() {
+		passwords = strings.Split(password, ":")
+	}
+	for _, p := range passwords {
+		key, err := spec.keyFromPassword(p)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	out := &Outbound{
+		addr:         addr,
+		name:         name,
+		config:       config,
+		spec:         spec,
+		key:          keys[len(keys)-1],
+		identityKeys: keys[:len(keys)-1],
+	}
+	_, err = proxy.UpperOutboundCreate(out, config)
+	return out, err
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+}
+func (out *Outbound) CloseAllConn() {
+	proxy.CloseAllConn(&out.closeChanSet)
+}
+
+// Shadowsocks出站代理模块中实现请求头发送、加密解密的IO流包装器函数
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	salt := make([]byte, out.spec.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := out.spec.sessionAEAD(out.key, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := &Conn{
+		Conn:        underlay,
+		spec:        out.spec,
+		key:         out.key,
+		writer:      aead,
+		writeNonce:  make([]byte, aead.NonceSize()),
+		requestSalt: salt,
+	}
+	//请求头：盐值 + 加密的代理目标，SIP022在目标后附加随机填充，并以定长头声明其长度
+	addr := socks5.AppendAddr(nil, target)
+	req := append([]byte{}, salt...)
+	for i, identityKey := range out.identityKeys {
+		block, err := aes.NewCipher(out.spec.identitySubkey(identityKey, salt))
+		if err != nil {
+			return nil, nil, err
+		}
+		next := out.key
+		if i+1 < len(out.identityKeys) {
+			next = out.identityKeys[i+1]
+		}
+		id := identityHash(next)
+		eih := make([]byte, aes.BlockSize)
+		block.Encrypt(eih, id[:])
+		req = append(req, eih...)
+	}
+	if out.spec.is2022 {
+		paddingLen, _ := utils.CryptoRandomInRange(1, 900)
+		addr = binary.BigEndian.AppendUint16(addr, uint16(paddingLen))
+		addr = append(addr, make([]byte, paddingLen)...)
+		header := []byte{headerTypeClient}
+		header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addr)))
+		req = conn.sealChunk(req, header)
+		req = conn.sealChunk(req, addr)
+	} else {
+		req = conn.sealPayload(req, addr)
+	}
+	if _, err := underlay.Write(req); err != nil {
+		return nil, nil, err
+	}
+
+	//处理上层叠加协议，返回处理后IO流
+	if out.upper != nil {
+		return out.upper.WrapConn(conn, target)
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return conn, closeChan, nil
+	}
+}
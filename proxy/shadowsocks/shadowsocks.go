@@ -0,0 +1,203 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+const scheme = "shadowsocks"
+
+const (
+	tagSize = 16
+	//经典AEAD协议单个加密块负载上限为0x3FFF，SIP022为0xFFFF
+	maxPayloadSize     = 0x3FFF
+	maxPayloadSize2022 = 0xFFFF
+
+	headerTypeClient = 0
+	headerTypeServer = 1
+	//SIP022时间戳允许的最大偏差，及盐值防重放记录的保留时间
+	maxTimeDiff   = 30 * time.Second
+	saltKeepAlive = 60 * time.Second
+)
+
+var (
+	errCipherNotSupported = errors.New("shadowsocks: cipher not supported")
+	errBadTimestamp       = errors.New("shadowsocks: bad timestamp")
+	errBadHeader          = errors.New("shadowsocks: bad header")
+	errReplay             = errors.New("shadowsocks: salt replayed")
+)
+
+// 加密方式描述，盐值长度与密钥长度相同
+type cipherSpec struct {
+	method  string
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	is2022  bool
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var cipherSpecs = map[string]*cipherSpec{
+	"aes-128-gcm":                   {"aes-128-gcm", 16, newGCM, false},
+	"aes-256-gcm":                   {"aes-256-gcm", 32, newGCM, false},
+	"chacha20-ietf-poly1305":        {"chacha20-ietf-poly1305", 32, chacha20poly1305.New, false},
+	"2022-blake3-aes-128-gcm":       {"2022-blake3-aes-128-gcm", 16, newGCM, true},
+	"2022-blake3-aes-256-gcm":       {"2022-blake3-aes-256-gcm", 32, newGCM, true},
+	"2022-blake3-chacha20-poly1305": {"2022-blake3-chacha20-poly1305", 32, chacha20poly1305.New, true},
+}
+
+func getCipherSpec(config map[string]interface{}) (*cipherSpec, error) {
+	method, ok := config["method"].(string)
+	if !ok {
+		return nil, fmt.Errorf("method is required")
+	}
+	spec, ok := cipherSpecs[method]
+	if !ok {
+		return nil, errCipherNotSupported
+	}
+	return spec, nil
+}
+
+func (s *cipherSpec) maxPayload() int {
+	if s.is2022 {
+		return maxPayloadSize2022
+	}
+	return maxPayloadSize
+}
+
+// 由配置中的密码得到主密钥，经典AEAD使用EVP_BytesToKey，SIP022密码为base64编码的密钥
+func (s *cipherSpec) keyFromPassword(password string) ([]byte, error) {
+	if !s.is2022 {
+		return evpBytesToKey(password, s.keySize), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != s.keySize {
+		return nil, fmt.Errorf("shadowsocks: psk must be %d bytes", s.keySize)
+	}
+	return key, nil
+}
+
+// 由用户linkToken得到客户端应填写的密码，SIP022要求密码为定长密钥，因此对linkToken做摘要后截取
+func (s *cipherSpec) passwordFromToken(token string) string {
+	if !s.is2022 {
+		return token
+	}
+	sum := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(sum[:s.keySize])
+}
+
+// 由主密钥和盐值派生会话子密钥，创建AEAD实例
+func (s *cipherSpec) sessionAEAD(key, salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, s.keySize)
+	if s.is2022 {
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(append([]byte{}, key...), salt...))
+	} else {
+		if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+			return nil, err
+		}
+	}
+	return s.newAEAD(subkey)
+}
+
+// 支持SIP022身份头的加密方式，身份头使用AES分组加密
+func (s *cipherSpec) supportsIdentity() bool {
+	return s.is2022 && strings.HasPrefix(s.method, "2022-blake3-aes-")
+}
+
+// 由身份密钥和盐值派生身份头的加密子密钥
+func (s *cipherSpec) identitySubkey(key, salt []byte) []byte {
+	subkey := make([]byte, s.keySize)
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", append(append([]byte{}, key...), salt...))
+	return subkey
+}
+
+// 身份头的明文为下一跳密钥blake3摘要的前16字节
+func identityHash(key []byte) [aes.BlockSize]byte {
+	var id [aes.BlockSize]byte
+	sum := blake3.Sum256(key)
+	copy(id[:], sum[:])
+	return id
+}
+
+func evpBytesToKey(password string, keyLen int) []byte {
+	var key, prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keyLen]
+}
+
+// 小端计数器形式的nonce自增
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// 盐值防重放记录，拒绝在保留时间内重复出现的盐值
+type saltPool struct {
+	mu    sync.Mutex
+	salts map[string]time.Time
+	last  time.Time
+}
+
+func newSaltPool() *saltPool {
+	return &saltPool{salts: make(map[string]time.Time)}
+}
+
+func (p *saltPool) check(salt []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Sub(p.last) > saltKeepAlive {
+		for k, t := range p.salts {
+			if now.Sub(t) > saltKeepAlive {
+				delete(p.salts, k)
+			}
+		}
+		p.last = now
+	}
+	if _, ok := p.salts[string(salt)]; ok {
+		return false
+	}
+	p.salts[string(salt)] = now
+	return true
+}
+
+func checkTimestamp(ts uint64) error {
+	diff := time.Since(time.Unix(int64(ts), 0))
+	if diff > maxTimeDiff || diff < -maxTimeDiff {
+		return errBadTimestamp
+	}
+	return nil
+}
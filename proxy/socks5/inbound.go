@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	upper        proxy.Inbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	requireAuth  bool
+}
+
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, Socks5InboundCreator)
+}
+
+// SOCKS5入站代理实例的创建函数，requireAuth为true时拒绝未认证或认证失败的客户端，否则按guest用户处理
+func Socks5InboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	in := &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+	}
+	if v, ok := config["requireAuth"].(bool); ok {
+		in.requireAuth = v
+	}
+	_, err := proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+}
+
+// SOCKS5入站代理模块中实现方法协商、用户名密码认证、CONNECT与UDP ASSOCIATE请求解析的IO流包装器函数
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	//读取客户端问候报文：VER NMETHODS METHODS
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(underlay, buf[:2]); err != nil {
+		return nil, nil, nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, nil, nil, errVersion
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(underlay, methods); err != nil {
+		return nil, nil, nil, err
+	}
+	//优先选择用户名密码认证，不要求认证时允许无认证方式
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodUserPass {
+			method = methodUserPass
+			break
+		}
+		if m == methodNoAuth && !in.requireAuth {
+			method = methodNoAuth
+		}
+	}
+	if _, err := underlay.Write([]byte{socksVersion, method}); err != nil {
+		return nil, nil, nil, err
+	}
+	if method == methodNoAcceptable {
+		return nil, nil, nil, errAuthFailed
+	}
+
+	userId := authFunc(map[string]string{})
+	if method == methodUserPass {
+		//RFC 1929 子协商：VER ULEN UNAME PLEN PASSWD
+		if _, err := io.ReadFull(underlay, buf[:2]); err != nil {
+			return nil, nil, nil, err
+		}
+		if buf[0] != authVersion {
+			return nil, nil, nil, errVersion
+		}
+		username := make([]byte, buf[1])
+		if _, err := io.ReadFull(underlay, username); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, err := io.ReadFull(underlay, buf[:1]); err != nil {
+			return nil, nil, nil, err
+		}
+		password := make([]byte, buf[0])
+		if _, err := io.ReadFull(underlay, password); err != nil {
+			return nil, nil, nil, err
+		}
+		//结合用户认证模块进行认证，密码也可以直接填写用户的linkToken
+		userId = authFunc(map[string]string{
+			"username":  string(username),
+			"password":  string(password),
+			"linkToken": string(password),
+		})
+		if userId == "guest" && in.requireAuth {
+			underlay.Write([]byte{authVersion, 0x01})
+			return nil, nil, nil, errAuthFailed
+		}
+		if _, err := underlay.Write([]byte{authVersion, 0x00}); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	//读取代理请求：VER CMD RSV DST.ADDR DST.PORT
+	if _, err := io.ReadFull(underlay, buf[:3]); err != nil {
+		return nil, nil, nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, nil, nil, errVersion
+	}
+	cmd := buf[1]
+	targetAddr, err := ReadAddr(underlay)
+	if err != nil {
+		if err == errAddrType {
+			underlay.Write(reply(repAddrNotSupported))
+		}
+		return nil, nil, nil, err
+	}
+	targetAddr.UserId = userId
+	if cmd == cmdUDPAssociate {
+		//UDP转发，返回的关联连接实现了proxy.PacketConn，各数据包目标由数据包自身携带
+		associateConn, err := newUDPAssociate(underlay)
+		if err != nil {
+			underlay.Write(reply(repGeneralFailure))
+			return nil, nil, nil, err
+		}
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return associateConn, targetAddr, closeChan, nil
+	}
+	if cmd != cmdConnect {
+		underlay.Write(reply(repCommandNotSupported))
+		return nil, nil, nil, fmt.Errorf("socks5: unsupported command %d", cmd)
+	}
+	//完成握手，后续IO流即为代理数据
+	if _, err := underlay.Write(reply(repSuccess)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	//处理上层叠加协议
+	if in.upper != nil {
+		innerConn, subTarget, closeChan, err := in.upper.WrapConn(underlay, authFunc)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if subTarget != nil {
+			targetAddr.Custom = subTarget.Custom
+		}
+		return innerConn, targetAddr, closeChan, err
+	} else {
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return underlay, targetAddr, closeChan, nil
+	}
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	addr := proxy.GetLinkAddr(in, defaultAccessAddr)
+	config := map[string]interface{}{
+		"scheme":    scheme,
+		"address":   addr,
+		"url":       scheme + "://" + addr,
+		"linkToken": token,
+	}
+	return config
+}
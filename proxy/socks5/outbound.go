@@ -0,0 +1,158 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+type Outbound struct {
+	addr         string
+	name         string
+	upper        proxy.Outbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	username     string
+	password     string
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, Socks5OutboundCreator)
+}
+
+// SOCKS5出站代理实例的创建函数，配置了username时使用用户名密码认证
+func Socks5OutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	out := &Outbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+	}
+	if v, ok := config["username"].(string); ok {
+		out.username = v
+	}
+	if v, ok := config["password"].(string); ok {
+		out.password = v
+	}
+	if len(out.username) > 255 || len(out.password) > 255 {
+		return nil, fmt.Errorf("username or password too long")
+	}
+
+	_, err := proxy.UpperOutboundCreate(out, config)
+	return out, err
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+}
+func (out *Outbound) CloseAllConn() {
+	proxy.CloseAllConn(&out.closeChanSet)
+}
+
+// SOCKS5出站代理模块中实现客户端握手的IO流包装器函数
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	//发送问候报文，配置了用户名时声明支持用户名密码认证
+	greeting := []byte{socksVersion, 1, methodNoAuth}
+	if out.username != "" {
+		greeting = []byte{socksVersion, 2, methodNoAuth, methodUserPass}
+	}
+	if _, err := underlay.Write(greeting); err != nil {
+		return nil, nil, err
+	}
+	buf := make([]byte, 257)
+	if _, err := io.ReadFull(underlay, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, nil, errVersion
+	}
+	switch buf[1] {
+	case methodNoAuth:
+	case methodUserPass:
+		if out.username == "" {
+			return nil, nil, errAuthFailed
+		}
+		req := []byte{authVersion, byte(len(out.username))}
+		req = append(req, out.username...)
+		req = append(req, byte(len(out.password)))
+		req = append(req, out.password...)
+		if _, err := underlay.Write(req); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.ReadFull(underlay, buf[:2]); err != nil {
+			return nil, nil, err
+		}
+		if buf[1] != 0x00 {
+			return nil, nil, errAuthFailed
+		}
+	default:
+		return nil, nil, errAuthFailed
+	}
+
+	//发送CONNECT请求，目标存在域名时由上级代理解析
+	req := AppendAddr([]byte{socksVersion, cmdConnect, 0x00}, target)
+	if _, err := underlay.Write(req); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(underlay, buf[:3]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, nil, errVersion
+	}
+	if buf[1] != repSuccess {
+		return nil, nil, fmt.Errorf("socks5: connect failed with reply %d", buf[1])
+	}
+	//丢弃应答中的绑定地址
+	if err := discardAddr(underlay, buf); err != nil {
+		return nil, nil, err
+	}
+
+	//处理上层叠加协议，返回处理后IO流
+	if out.upper != nil {
+		return out.upper.WrapConn(underlay, target)
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return underlay, closeChan, nil
+	}
+}
+
+func discardAddr(r io.Reader, buf []byte) error {
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return err
+	}
+	var n int
+	switch buf[0] {
+	case AtypIPv4:
+		n = net.IPv4len
+	case AtypIPv6:
+		n = net.IPv6len
+	case AtypDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return errAddrType
+	}
+	_, err := io.ReadFull(r, buf[:n+2])
+	return err
+}
@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+const scheme = "socks5"
+
+// RFC 1928 / RFC 1929 协议常量
+const (
+	socksVersion = 0x05
+	authVersion  = 0x01
+
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+
+	AtypIPv4   = 0x01
+	AtypDomain = 0x03
+	AtypIPv6   = 0x04
+
+	repSuccess             = 0x00
+	repGeneralFailure      = 0x01
+	repCommandNotSupported = 0x07
+	repAddrNotSupported    = 0x08
+)
+
+var (
+	errVersion    = errors.New("socks5: unsupported version")
+	errAddrType   = errors.New("socks5: unsupported address type")
+	errAuthFailed = errors.New("socks5: authentication failed")
+)
+
+// ReadAddr 按照SOCKS5地址格式(ATYP + DST.ADDR + DST.PORT)读取代理目标，Trojan、Shadowsocks等协议也复用该格式
+func ReadAddr(r io.Reader) (*proxy.TargetAddr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+	var host string
+	switch atyp[0] {
+	case AtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case AtypIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case AtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		return nil, errAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	return proxy.NewTargetAddr(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))))
+}
+
+// AppendAddr 将代理目标按SOCKS5地址格式追加到b，存在域名时优先使用域名，交由下一级代理解析
+func AppendAddr(b []byte, target *proxy.TargetAddr) []byte {
+	if target.Hostname != "" && len(target.Hostname) <= 255 {
+		b = append(b, AtypDomain, byte(len(target.Hostname)))
+		b = append(b, target.Hostname...)
+	} else if ip4 := target.IP.To4(); ip4 != nil {
+		b = append(b, AtypIPv4)
+		b = append(b, ip4...)
+	} else if ip6 := target.IP.To16(); ip6 != nil {
+		b = append(b, AtypIPv6)
+		b = append(b, ip6...)
+	} else {
+		b = append(b, AtypIPv4, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(target.Port))
+}
+
+// 构造SOCKS5应答报文，绑定地址固定为0.0.0.0:0
+func reply(rep byte) []byte {
+	return []byte{socksVersion, rep, 0x00, AtypIPv4, 0, 0, 0, 0, 0, 0}
+}
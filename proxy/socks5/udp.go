@@ -0,0 +1,105 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// UDP ASSOCIATE关联连接，嵌入TCP控制连接以满足net.Conn，同时实现proxy.PacketConn。
+// 控制连接关闭时关联随之结束。
+type udpAssociateConn struct {
+	net.Conn
+	udpConn    *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	readBuf    []byte //ReadPacket的接收缓冲，由单一协程读取，复用以避免每个报文分配
+	mu         sync.RWMutex
+	closeOnce  sync.Once
+}
+
+// 在控制连接本地IP上监听UDP中继端口，并按RFC 1928应答中继地址
+func newUDPAssociate(control net.Conn) (*udpAssociateConn, error) {
+	localAddr, ok := control.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("socks5: udp associate requires tcp control connection")
+	}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		return nil, err
+	}
+	c := &udpAssociateConn{
+		Conn:    control,
+		udpConn: udpConn,
+		readBuf: make([]byte, 65535),
+	}
+	if remoteAddr, ok := control.RemoteAddr().(*net.TCPAddr); ok {
+		c.clientIP = remoteAddr.IP
+	}
+	bindAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	resp := AppendAddr([]byte{socksVersion, repSuccess, 0x00}, &proxy.TargetAddr{IP: bindAddr.IP, Port: bindAddr.Port})
+	if _, err := control.Write(resp); err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	//控制连接不再传输数据，读到EOF即代表客户端结束关联
+	go func() {
+		io.Copy(io.Discard, control)
+		c.Close()
+	}()
+	return c, nil
+}
+
+// ReadPacket 读取客户端UDP报文：RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA，忽略分片报文和非控制连接来源的报文
+func (c *udpAssociateConn) ReadPacket(b []byte) (int, *proxy.TargetAddr, error) {
+	buf := c.readBuf
+	for {
+		n, addr, err := c.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.clientIP != nil && !c.clientIP.Equal(addr.IP) {
+			continue
+		}
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		target, err := ReadAddr(r)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.clientAddr = addr
+		c.mu.Unlock()
+		return copy(b, buf[n-r.Len():n]), target, nil
+	}
+}
+
+// WritePacket 将目标返回的数据按SOCKS5 UDP报文格式发回客户端，addr为数据来源地址
+func (c *udpAssociateConn) WritePacket(b []byte, addr *proxy.TargetAddr) (int, error) {
+	c.mu.RLock()
+	clientAddr := c.clientAddr
+	c.mu.RUnlock()
+	if clientAddr == nil {
+		return 0, errors.New("socks5: udp client address unknown")
+	}
+	packet := AppendAddr([]byte{0x00, 0x00, 0x00}, addr)
+	packet = append(packet, b...)
+	if _, err := c.udpConn.WriteToUDP(packet, clientAddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpAssociateConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.udpConn.Close()
+		c.Conn.Close()
+	})
+	return nil
+}
@@ -75,6 +75,7 @@ func TlsInboundCreator(name string, config map[string]interface{}) (proxy.Inboun
 	in.tlsConfig = &stdtls.Config{
 		InsecureSkipVerify: in.verifyByPsk != "",
 		Certificates:       []stdtls.Certificate{cert},
+		NextProtos:         configALPN(config),
 	}
 
 	_, err = proxy.UpperInboundCreate(in, config)
@@ -131,6 +132,9 @@ func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]int
 	config["scheme"] = scheme
 	config["verifyByPsk"] = in.verifyByPsk
 	config["address"] = proxy.GetLinkAddr(in, defaultAccessAddr)
+	if alpn, ok := in.config["alpn"]; ok {
+		config["alpn"] = alpn
+	}
 	if in.upper != nil {
 		upperConfig := in.upper.GetLinkConfig(defaultAccessAddr, token)
 		config["upper"] = upperConfig
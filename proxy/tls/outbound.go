@@ -19,6 +19,7 @@ type Outbound struct {
 	tlsConfig    *stdtls.Config
 	closeChanSet sync.Map
 	verifyByPsk  string
+	alpn         []string
 }
 
 func (out *Outbound) Scheme() string                 { return scheme }
@@ -45,6 +46,7 @@ func TlsOutboundCreator(name string, config map[string]interface{}) (proxy.Outbo
 		addr:   addr,
 		name:   name,
 		config: config,
+		alpn:   configALPN(config),
 	}
 	_, err := proxy.UpperOutboundCreate(out, config)
 	if err != nil {
@@ -88,6 +90,7 @@ func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.
 	out.tlsConfig = &stdtls.Config{
 		ServerName:         sni,
 		InsecureSkipVerify: out.verifyByPsk != "",
+		NextProtos:         out.alpn,
 	}
 	//利用crypto/tls包处理TLS IO流
 	tlsConn := stdtls.Client(underlay, out.tlsConfig)
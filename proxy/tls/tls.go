@@ -1,3 +1,15 @@
 package tls
 
 const scheme = "tls"
+
+// 读取配置中的ALPN协议列表，如与第三方h2/grpc传输对接时需协商"h2"
+func configALPN(config map[string]interface{}) []string {
+	list, _ := config["alpn"].([]interface{})
+	var protos []string
+	for _, v := range list {
+		if proto, ok := v.(string); ok {
+			protos = append(protos, proto)
+		}
+	}
+	return protos
+}
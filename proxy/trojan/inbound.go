@@ -0,0 +1,183 @@
+package trojan
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/socks5"
+	"github.com/ZIXT233/ziproxy/utils"
+)
+
+type Inbound struct {
+	addr         string
+	name         string
+	upper        proxy.Inbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	tokens       *proxy.TokenTable[map[string]string] //密码摘要 -> linkToken
+}
+
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, TrojanInboundCreator)
+}
+
+// Trojan入站代理实例的创建函数，一般作为tls入站代理的upper使用，用户密码即linkToken
+func TrojanInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	in := &Inbound{
+		addr:   addr,
+		name:   name,
+		config: config,
+	}
+	in.tokens = proxy.NewTokenTable(func(tokens []string) map[string]string {
+		hashes := make(map[string]string, len(tokens))
+		for _, token := range tokens {
+			hashes[utils.SHA224([]byte(token))] = token
+		}
+		return hashes
+	})
+	_, err := proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+}
+func (in *Inbound) CloseAllConn() {
+	proxy.CloseAllConn(&in.closeChanSet)
+}
+
+// 根据密码摘要查找对应用户的linkToken
+func (in *Inbound) lookupToken(hash []byte) (string, bool) {
+	token, ok := in.tokens.Load()[string(hash)]
+	return token, ok
+}
+
+// 判断数据是否可能为十六进制密码摘要的开头
+func isHexPrefix(b []byte) bool {
+	for _, c := range b[:min(len(b), hashLen)] {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// Trojan入站代理模块中实现密码校验、请求解析的IO流包装器函数，校验失败时转发到fallback地址
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	//探测流，校验失败时已探测的数据会原样转发给fallback
+	peekConn := utils.NewPeekConn(underlay)
+	b, err := peekConn.Peek(1024)
+	//密码行可能被拆分在多个TLS记录中，数据不足且仍符合摘要格式时继续读取
+	if err == nil && len(b) < hashLen+2 && isHexPrefix(b) {
+		b, err = peekConn.PeekAtLeast(hashLen + 2)
+	}
+	if err != nil && len(b) == 0 {
+		return nil, nil, nil, err
+	}
+	token, ok := "", false
+	if len(b) >= hashLen+2 && bytes.Equal(b[hashLen:hashLen+2], crlf) {
+		token, ok = in.lookupToken(b[:hashLen])
+	}
+	if !ok {
+		//实现端口防探测保护，密码错误的流量转发到fallback对应地址，该地址一般对应非代理服务
+		forward := in.config["fallback"]
+		if forward == nil {
+			return nil, nil, nil, fmt.Errorf("trojan: auth fail")
+		}
+		forwardAddr, ok := forward.(string)
+		if !ok {
+			return nil, nil, nil, fmt.Errorf("fallback config error")
+		}
+		forwardConn, err := net.Dial("tcp", forwardAddr)
+		if err != nil {
+			log.Println("dial", err)
+			return nil, nil, nil, err
+		}
+		defer forwardConn.Close()
+		log.Printf("auth fail, forward to %s", forwardAddr)
+		go io.Copy(forwardConn, peekConn)
+		io.Copy(peekConn, forwardConn)
+		return nil, nil, nil, fmt.Errorf("auth fail")
+	}
+
+	//请求格式：HEX(SHA224(password)) CRLF CMD ATYP DST.ADDR DST.PORT CRLF Payload
+	head := make([]byte, hashLen+3)
+	if _, err := io.ReadFull(peekConn, head); err != nil {
+		return nil, nil, nil, err
+	}
+	cmd := head[hashLen+2]
+	targetAddr, err := socks5.ReadAddr(peekConn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if _, err := io.ReadFull(peekConn, head[:2]); err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.Equal(head[:2], crlf) {
+		return nil, nil, nil, errBadHeader
+	}
+	targetAddr.UserId = authFunc(map[string]string{"linkToken": token})
+
+	var wrappedConn net.Conn = peekConn
+	switch cmd {
+	case cmdConnect:
+	case cmdUDPAssociate:
+		//UDP转发，各数据包目标由数据包自身携带
+		wrappedConn = &packetConn{Conn: peekConn}
+	default:
+		return nil, nil, nil, fmt.Errorf("trojan: unsupported command %d", cmd)
+	}
+
+	//处理上层叠加协议
+	if in.upper != nil && cmd == cmdConnect {
+		innerConn, subTarget, closeChan, err := in.upper.WrapConn(wrappedConn, authFunc)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if subTarget != nil {
+			targetAddr.Custom = subTarget.Custom
+		}
+		return innerConn, targetAddr, closeChan, err
+	} else {
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return wrappedConn, targetAddr, closeChan, nil
+	}
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	addr := proxy.GetLinkAddr(in, defaultAccessAddr)
+	config := map[string]interface{}{
+		"scheme":   scheme,
+		"address":  addr,
+		"password": token,
+		"url":      scheme + "://" + url.PathEscape(token) + "@" + addr + "#" + url.PathEscape(in.name),
+	}
+	return config
+}
@@ -0,0 +1,81 @@
+package trojan
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/socks5"
+	"github.com/ZIXT233/ziproxy/utils"
+)
+
+type Outbound struct {
+	addr         string
+	name         string
+	upper        proxy.Outbound
+	config       map[string]interface{}
+	closeChanSet sync.Map
+	passwordHash string
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, TrojanOutboundCreator)
+}
+
+// Trojan出站代理实例的创建函数，一般作为tls出站代理的upper使用
+func TrojanOutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	password, ok := config["password"].(string)
+	if !ok {
+		return nil, fmt.Errorf("password is required")
+	}
+	out := &Outbound{
+		addr:         addr,
+		name:         name,
+		config:       config,
+		passwordHash: utils.SHA224([]byte(password)),
+	}
+	_, err := proxy.UpperOutboundCreate(out, config)
+	return out, err
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+}
+func (out *Outbound) CloseAllConn() {
+	proxy.CloseAllConn(&out.closeChanSet)
+}
+
+// Trojan出站代理模块中发送请求头的IO流包装器函数
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	req := append([]byte(out.passwordHash), crlf...)
+	req = append(req, cmdConnect)
+	req = socks5.AppendAddr(req, target)
+	req = append(req, crlf...)
+	if _, err := underlay.Write(req); err != nil {
+		return nil, nil, err
+	}
+	//处理上层叠加协议，返回处理后IO流
+	if out.upper != nil {
+		return out.upper.WrapConn(underlay, target)
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return underlay, closeChan, nil
+	}
+}
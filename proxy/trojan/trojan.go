@@ -0,0 +1,61 @@
+package trojan
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+	"github.com/ZIXT233/ziproxy/proxy/socks5"
+)
+
+const scheme = "trojan"
+
+const (
+	hashLen         = 56
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+)
+
+var (
+	crlf         = []byte("\r\n")
+	errBadHeader = errors.New("trojan: bad header")
+)
+
+// Trojan UDP数据包连接，数据包在流中按 ATYP DST.ADDR DST.PORT Length CRLF Payload 格式传输
+type packetConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *packetConn) ReadPacket(b []byte) (int, *proxy.TargetAddr, error) {
+	target, err := socks5.ReadAddr(c.Conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(c.Conn, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(head[:2]))
+	if length > len(b) {
+		return 0, nil, errors.New("trojan: packet too large")
+	}
+	n, err := io.ReadFull(c.Conn, b[:length])
+	return n, target, err
+}
+
+func (c *packetConn) WritePacket(b []byte, addr *proxy.TargetAddr) (int, error) {
+	packet := socks5.AppendAddr(nil, addr)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(b)))
+	packet = append(packet, crlf...)
+	packet = append(packet, b...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,167 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+type Inbound struct {
+	addr            string
+	name            string
+	upper           proxy.Inbound
+	config          map[string]interface{}
+	closeChanSet    sync.Map
+	path            string
+	earlyDataHeader string
+}
+
+func (in *Inbound) Scheme() string                 { return scheme }
+func (in *Inbound) Addr() string                   { return in.addr }
+func (in *Inbound) Name() string                   { return in.name }
+func (in *Inbound) Config() map[string]interface{} { return in.config }
+
+func (in *Inbound) SetAddr(addr string) {
+	in.addr = addr
+}
+func (in *Inbound) SetUpper(upper proxy.Inbound) {
+	in.upper = upper
+}
+func (in *Inbound) Stop() {
+	in.CloseAllConn()
+	return
+}
+
+func init() {
+	proxy.RegisterInbound(scheme, WsInboundCreator)
+}
+
+// WebSocket入站代理实例的创建函数，path为握手请求路径，earlyDataHeader为携带early data的请求头
+func WsInboundCreator(name string, config map[string]interface{}) (proxy.Inbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	in := &Inbound{
+		addr:            addr,
+		name:            name,
+		config:          config,
+		path:            configString(config, "path", "/"),
+		earlyDataHeader: configString(config, "earlyDataHeader", defaultEarlyDataHeader),
+	}
+	_, err := proxy.UpperInboundCreate(in, config)
+	return in, err
+}
+
+func (in *Inbound) UnregCloseChan(closeChan chan struct{}) {
+	if in.upper != nil {
+		in.upper.UnregCloseChan(closeChan)
+	} else {
+		proxy.UnregCloseChan(&in.closeChanSet, closeChan)
+	}
+}
+func (in *Inbound) CloseAllConn() {
+	if in.upper != nil {
+		in.upper.CloseAllConn()
+	} else {
+		proxy.CloseAllConn(&in.closeChanSet)
+	}
+}
+
+// 带early data的WebSocket IO流，先读出握手请求头中携带的数据
+type earlyDataConn struct {
+	*Conn
+	early io.Reader
+}
+
+func (c *earlyDataConn) Read(b []byte) (int, error) {
+	if c.early != nil {
+		n, err := c.early.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		c.early = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+// WebSocket入站代理模块中实现握手、帧解析的IO流包装器函数
+func (in *Inbound) WrapConn(underlay net.Conn, authFunc func(map[string]string) string) (net.Conn, *proxy.TargetAddr, chan struct{}, error) {
+	reader := bufio.NewReader(underlay)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if req.URL.Path != in.path || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		fmt.Fprint(underlay, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, nil, nil, fmt.Errorf("ws: bad handshake path %s", req.URL.Path)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		fmt.Fprint(underlay, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, nil, nil, fmt.Errorf("ws: missing Sec-WebSocket-Key")
+	}
+	//early data以base64url编码放在请求头中，使用Sec-WebSocket-Protocol时需要原样应答
+	var early []byte
+	var protocolHeader string
+	if v := req.Header.Get(in.earlyDataHeader); v != "" {
+		early, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if strings.EqualFold(in.earlyDataHeader, "Sec-WebSocket-Protocol") {
+			protocolHeader = "Sec-WebSocket-Protocol: " + v + "\r\n"
+		}
+	}
+	_, err = fmt.Fprintf(underlay, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"%s"+
+		"\r\n", acceptKey(key), protocolHeader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var wsConn net.Conn = newConn(underlay, reader, false)
+	if len(early) > 0 {
+		wsConn = &earlyDataConn{Conn: wsConn.(*Conn), early: bytes.NewReader(early)}
+	}
+
+	//处理上层叠加协议，返回包装后IO流
+	if in.upper != nil {
+		return in.upper.WrapConn(wsConn, authFunc)
+	} else {
+		closeChan := make(chan struct{})
+		in.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return wsConn, nil, closeChan, nil
+	}
+}
+
+func (in *Inbound) GetLinkConfig(defaultAccessAddr, token string) map[string]interface{} {
+	config := make(map[string]interface{})
+	config["scheme"] = scheme
+	config["address"] = proxy.GetLinkAddr(in, defaultAccessAddr)
+	config["path"] = in.path
+	if host, ok := in.config["host"]; ok {
+		config["host"] = host
+	}
+	if maxEarlyData, ok := in.config["maxEarlyData"]; ok {
+		config["maxEarlyData"] = maxEarlyData
+		config["earlyDataHeader"] = in.earlyDataHeader
+	}
+	if in.upper != nil {
+		config["upper"] = in.upper.GetLinkConfig(defaultAccessAddr, token)
+	}
+	return config
+}
@@ -0,0 +1,200 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ZIXT233/ziproxy/proxy"
+)
+
+// 使用early data时，读方向等待首次写入的最长时间
+const earlyDataWait = 200 * time.Millisecond
+
+type Outbound struct {
+	addr            string
+	name            string
+	upper           proxy.Outbound
+	config          map[string]interface{}
+	closeChanSet    sync.Map
+	path            string
+	host            string
+	maxEarlyData    int
+	earlyDataHeader string
+}
+
+func (out *Outbound) Scheme() string                 { return scheme }
+func (out *Outbound) Addr() string                   { return out.addr }
+func (out *Outbound) Name() string                   { return out.name }
+func (out *Outbound) Config() map[string]interface{} { return out.config }
+func (out *Outbound) SetAddr(addr string) {
+	out.addr = addr
+}
+func (out *Outbound) SetUpper(upper proxy.Outbound) {
+	out.upper = upper
+}
+
+func init() {
+	proxy.RegisterOutbound(scheme, WsOutboundCreator)
+}
+
+// WebSocket出站代理实例的创建函数，maxEarlyData大于0时首段数据随握手请求头发送，节省一个往返
+func WsOutboundCreator(name string, config map[string]interface{}) (proxy.Outbound, error) {
+	addr, ok := config["address"].(string)
+	if !ok {
+		return nil, fmt.Errorf("address is required")
+	}
+	out := &Outbound{
+		addr:            addr,
+		name:            name,
+		config:          config,
+		path:            configString(config, "path", "/"),
+		host:            configString(config, "host", ""),
+		maxEarlyData:    configInt(config, "maxEarlyData"),
+		earlyDataHeader: configString(config, "earlyDataHeader", defaultEarlyDataHeader),
+	}
+	_, err := proxy.UpperOutboundCreate(out, config)
+	return out, err
+}
+
+func (out *Outbound) UnregCloseChan(closeChan chan struct{}) {
+	if out.upper != nil {
+		out.upper.UnregCloseChan(closeChan)
+	} else {
+		proxy.UnregCloseChan(&out.closeChanSet, closeChan)
+	}
+}
+func (out *Outbound) CloseAllConn() {
+	if out.upper != nil {
+		out.upper.CloseAllConn()
+	} else {
+		proxy.CloseAllConn(&out.closeChanSet)
+	}
+}
+
+// 客户端侧WebSocket IO流，握手推迟到首次写入时进行，首次写入的数据作为early data随握手请求头发送。
+// 如果earlyDataWait内没有写入(如服务端先发数据的协议)，则由读方向直接完成握手。
+type clientConn struct {
+	*Conn
+	out          *Outbound
+	host         string
+	mu           sync.Mutex
+	handshaked   atomic.Bool
+	handshakeErr error
+	ready        chan struct{}
+}
+
+// 完成握手，返回early data是否随本次握手发送
+func (c *clientConn) handshake(early []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handshaked.Load() {
+		return false, c.handshakeErr
+	}
+	defer close(c.ready)
+	defer c.handshaked.Store(true)
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+	var earlyHeader string
+	if len(early) > 0 {
+		earlyHeader = c.out.earlyDataHeader + ": " + base64.RawURLEncoding.EncodeToString(early) + "\r\n"
+	}
+	_, err := fmt.Fprintf(c.Conn.Conn, "GET %s HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"%s"+
+		"\r\n", c.out.path, c.host, key, earlyHeader)
+	if err != nil {
+		c.handshakeErr = err
+		return true, err
+	}
+	resp, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		c.handshakeErr = err
+		return true, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		c.handshakeErr = fmt.Errorf("ws: handshake failed with status %s", resp.Status)
+	}
+	return true, c.handshakeErr
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if !c.handshaked.Load() {
+		select {
+		case <-c.ready:
+		case <-time.After(earlyDataWait):
+		}
+		if _, err := c.handshake(nil); err != nil {
+			return 0, err
+		}
+	}
+	if c.handshakeErr != nil {
+		return 0, c.handshakeErr
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	if !c.handshaked.Load() {
+		early := b
+		if len(early) > c.out.maxEarlyData {
+			early = early[:c.out.maxEarlyData]
+		}
+		sent, err := c.handshake(early)
+		if err != nil {
+			return 0, err
+		}
+		if sent {
+			if len(early) == len(b) {
+				return len(b), nil
+			}
+			n, err := c.Conn.Write(b[len(early):])
+			return n + len(early), err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// WebSocket出站代理模块中的IO流包装器函数
+func (out *Outbound) WrapConn(underlay net.Conn, target *proxy.TargetAddr) (net.Conn, chan struct{}, error) {
+	host := out.host
+	if host == "" {
+		if out.addr != "direct" {
+			host = out.addr
+		} else {
+			host = target.String()
+		}
+	}
+	wsConn := &clientConn{
+		Conn:  newConn(underlay, bufio.NewReader(underlay), true),
+		out:   out,
+		host:  host,
+		ready: make(chan struct{}),
+	}
+	//不使用early data时立即完成握手
+	if out.maxEarlyData <= 0 {
+		if _, err := wsConn.handshake(nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//处理上层叠加协议，返回包装后IO流
+	if out.upper != nil {
+		return out.upper.WrapConn(wsConn, target)
+	} else {
+		closeChan := make(chan struct{})
+		out.closeChanSet.LoadOrStore(closeChan, struct{}{})
+		return wsConn, closeChan, nil
+	}
+}
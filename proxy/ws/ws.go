@@ -0,0 +1,191 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const scheme = "ws"
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	defaultEarlyDataHeader = "Sec-WebSocket-Protocol"
+)
+
+var errBadFrame = errors.New("ws: bad frame")
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func configString(config map[string]interface{}, key, def string) string {
+	if v, ok := config[key].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func configInt(config map[string]interface{}, key string) int {
+	if v, ok := config[key].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+// WebSocket IO流，写入的数据封装为二进制帧，读取时拼接数据帧负载并自动应答ping和close控制帧。
+// 客户端发送的帧需要掩码，服务端发送的帧不带掩码。
+type Conn struct {
+	net.Conn
+	reader    *bufio.Reader
+	isClient  bool
+	remaining uint64
+	maskKey   [4]byte
+	masked    bool
+	maskPos   int
+	writeMu   sync.Mutex
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, isClient bool) *Conn {
+	return &Conn{Conn: conn, reader: reader, isClient: isClient}
+}
+
+// 读取帧头，控制帧在此处理完毕，返回时remaining为数据帧负载长度
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0f
+	c.masked = head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.maskKey[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errBadFrame
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case opPing:
+			_, err := c.writeFrame(opPong, payload)
+			return err
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return io.EOF
+		}
+		return nil
+	default:
+		return errBadFrame
+	}
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.maskKey[c.maskPos%4]
+		c.maskPos++
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) (int, error) {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.isClient {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return 0, err
+		}
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[start+i] ^= key[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.writeFrame(opBinary, b)
+}
@@ -6,15 +6,29 @@ import (
 )
 
 type RootConfig struct {
-	DB          string `json:"db"`
-	StatisticDB string `json:"statistic_db"`
-	WebAddress  string `json:"web_address"`
-	WebSecret   string `json:"web_secret"`
-	StaticPath  string `json:"static_path"`
-	MITMCACert  string `json:"mitm_ca_cert"`
-	MITMCAKey   string `json:"mitm_ca_key"`
-	BadgerDir   string `json:"badger_dir"`
-	BadgerSize  int    `json:"badger_size"`
+	DB                  string    `json:"db"`
+	StatisticDB         string    `json:"statistic_db"`
+	WebAddress          string    `json:"web_address"`
+	WebSecret           string    `json:"web_secret"`
+	StaticPath          string    `json:"static_path"`
+	MITMCACert          string    `json:"mitm_ca_cert"`
+	MITMCAKey           string    `json:"mitm_ca_key"`
+	BadgerDir           string    `json:"badger_dir"`
+	BadgerSize          int       `json:"badger_size"`
+	DialRetry           int       `json:"dial_retry"`            //出站代理拨号失败时最多尝试的出站代理数量
+	DialTimeout         int       `json:"dial_timeout"`          //每次尝试的拨号及握手超时秒数
+	ProbeURL            string    `json:"probe_url"`             //出站代理测速请求地址
+	HealthCheckInterval int       `json:"health_check_interval"` //出站代理健康检查间隔秒数，负数时关闭
+	RuleSetDir          string    `json:"rule_set_dir"`          //远程规则集缓存目录
+	PACGuest            bool      `json:"pac_guest"`             //未携带令牌的PAC/WPAD请求按guest用户生成
+	DNS                 DNSConfig `json:"dns"`
+}
+
+type DNSConfig struct {
+	Servers     []string          `json:"servers"`       //上游DNS服务器，未配置时使用系统解析
+	Hosts       map[string]string `json:"hosts"`         //静态解析记录，多个地址以逗号分隔
+	Timeout     int               `json:"timeout"`       //查询超时秒数
+	FakeIPRange string            `json:"fake_ip_range"` //Fake-IP地址池范围，为空时不启用
 }
 
 func LoadRootConfig(file string) (*RootConfig, error) {
@@ -45,6 +45,21 @@ func (c *PeekConn) Peek(n int) ([]byte, error) {
 	return c.buf.Bytes(), err
 }
 
+// PeekAtLeast 窥探至少 n 字节的数据，缓冲不足时继续从底层连接读取，只能在读取数据前调用
+func (c *PeekConn) PeekAtLeast(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	for c.buf.Len() < n {
+		numRead, err := c.conn.Read(buf[:n-c.buf.Len()])
+		c.buf.Write(buf[:numRead])
+		if err != nil {
+			c.peeked = true
+			return c.buf.Bytes(), err
+		}
+	}
+	c.peeked = true
+	return c.buf.Bytes(), nil
+}
+
 // Read 实现 net.Conn 接口的 Read 方法
 func (c *PeekConn) Read(b []byte) (n int, err error) {
 	// 先读取缓冲中的数据
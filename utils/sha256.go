@@ -10,3 +10,9 @@ func SHA256(data []byte) string {
 	h.Write(data)
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+func SHA224(data []byte) string {
+	h := sha256.New224()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}